@@ -0,0 +1,69 @@
+package migrator
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// InterruptedError is returned by RunContext when the context is done before the end of the migration.
+// It wraps the error of the context, which can be matched with errors.Is.
+type InterruptedError struct {
+	// Versions of the step being run, empty if no step started
+	From, To string
+	// Bucket being migrated, if any
+	Bucket string
+	// Number of records of the bucket migrated before the interruption.
+	// They are only kept if the destination can be resumed
+	Records int
+	// Resumable is true if the destination was kept, the migration can be resumed using the Resume option
+	Resumable bool
+	Err       error
+}
+
+func (e *InterruptedError) Error() string {
+	parts := []string{"migration interrupted"}
+	if e.From != "" || e.To != "" {
+		parts = append(parts, fmt.Sprintf("step %s -> %s", e.From, e.To))
+	}
+	if e.Bucket != "" {
+		parts = append(parts, fmt.Sprintf("bucket %s after %d records", e.Bucket, e.Records))
+	}
+	if e.Resumable {
+		parts = append(parts, "resumable")
+	}
+
+	return fmt.Sprintf("%s: %v", strings.Join(parts, ", "), e.Err)
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// interrupted describes where the migration stopped. The destination is removed unless the Resume option is used,
+// in which case it keeps the checkpoint of the migration.
+func (m *Migrator) interrupted(dst string) error {
+	err := &InterruptedError{
+		From:    m.progress.From,
+		To:      m.progress.To,
+		Bucket:  m.progress.Bucket,
+		Records: m.progress.Records,
+		Err:     m.ctx.Err(),
+	}
+
+	_, serr := os.Stat(dst)
+	if serr != nil {
+		return err
+	}
+
+	if m.resume {
+		err.Resumable = true
+		return err
+	}
+
+	rerr := os.Remove(dst)
+	if rerr != nil {
+		return fmt.Errorf("%w, removing the destination failed: %v", err, rerr)
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package migrator_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunContext(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dst := filepath.Join(dir, "v06.db")
+	newMigrator := func() *migrator.Migrator {
+		m := migrator.New(path)
+		m.AddBuckets(new(A), new(B))
+		m.AddKV("bucket", []interface{}{new(int), new(string)})
+		return m
+	}
+
+	// cancel once the given number of records of the bucket are migrated by the step to the given version
+	cancelAt := func(to, bucket string, records int) (context.Context, func(*migrator.Migrator) error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		return ctx, migrator.OnEvent(func(e migrator.Event) {
+			if e.Type == migrator.RecordsProcessed && e.To == to && e.Bucket == bucket && e.Records == records {
+				cancel()
+			}
+		})
+	}
+
+	// the context is checked before the first step
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := newMigrator().RunContext(ctx, dst)
+	require.True(t, errors.Is(err, context.Canceled))
+	var ierr *migrator.InterruptedError
+	require.True(t, errors.As(err, &ierr))
+	require.Empty(t, ierr.From)
+	require.False(t, ierr.Resumable)
+	_, err = os.Stat(dst)
+	require.True(t, os.IsNotExist(err))
+
+	// the partial destination is removed.
+	// The records are saved in batches, the context is checked before the next batch
+	ctx, onEvent := cancelAt("0.5", "B", 2)
+	err = newMigrator().RunContext(ctx, dst, onEvent, migrator.ProgressInterval(1), migrator.BatchSize(2))
+	require.True(t, errors.Is(err, context.Canceled))
+	require.True(t, errors.As(err, &ierr))
+	require.Equal(t, "0.4", ierr.From)
+	require.Equal(t, "0.5", ierr.To)
+	require.Equal(t, "B", ierr.Bucket)
+	require.Equal(t, 2, ierr.Records)
+	require.False(t, ierr.Resumable)
+	require.Equal(t, "migration interrupted, step 0.4 -> 0.5, bucket B after 2 records: context canceled", err.Error())
+	_, err = os.Stat(dst)
+	require.True(t, os.IsNotExist(err))
+
+	// with Resume, it is kept and the migration can be resumed
+	ctx, onEvent = cancelAt("0.6", "A", 4)
+	err = newMigrator().RunContext(ctx, dst, onEvent, migrator.ProgressInterval(1), migrator.Resume())
+	require.True(t, errors.As(err, &ierr))
+	require.Equal(t, "0.6", ierr.To)
+	require.Equal(t, "A", ierr.Bucket)
+	require.True(t, ierr.Resumable)
+	_, err = os.Stat(dst)
+	require.NoError(t, err)
+
+	ctx, onEvent = cancelAt("0.6", "B", 2)
+	err = newMigrator().RunContext(ctx, dst, onEvent, migrator.ProgressInterval(1), migrator.Resume())
+	require.True(t, errors.As(err, &ierr))
+	require.Equal(t, "B", ierr.Bucket)
+
+	err = newMigrator().RunContext(context.Background(), dst, migrator.Resume(), migrator.Verify())
+	require.NoError(t, err)
+
+	history, err := migrator.History(dst)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+
+	db, err := stormv06.Open(dst)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var list []A
+	err = db.All(&list)
+	require.NoError(t, err)
+	require.Len(t, list, 10)
+}
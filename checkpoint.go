@@ -0,0 +1,98 @@
+package migrator
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// The versioned migrators record their progress in a bucket nested in the dbinfo bucket.
+// The migrator records the step being run in the same bucket.
+const (
+	checkpointBucket    = "checkpoint"
+	checkpointStep      = "step"
+	checkpointConverted = "converted"
+)
+
+// startStep records the step in the checkpoint. The checkpoint is reset if it was left by another step,
+// otherwise the step resumes from it.
+func startStep(b *bolt.DB, s Step) error {
+	name := []byte(s.FromVersion() + " -> " + s.ToVersion())
+
+	return b.Update(func(tx *bolt.Tx) error {
+		info, err := tx.CreateBucketIfNotExists([]byte(dbinfoBucket))
+		if err != nil {
+			return err
+		}
+
+		if c := info.Bucket([]byte(checkpointBucket)); c != nil {
+			if string(c.Get([]byte(checkpointStep))) == string(name) {
+				return nil
+			}
+
+			err = info.DeleteBucket([]byte(checkpointBucket))
+			if err != nil {
+				return err
+			}
+		}
+
+		c, err := info.CreateBucket([]byte(checkpointBucket))
+		if err != nil {
+			return err
+		}
+
+		return c.Put([]byte(checkpointStep), name)
+	})
+}
+
+// clearCheckpoint removes the checkpoint once all the steps are done.
+func clearCheckpoint(b *bolt.DB) error {
+	return b.Update(func(tx *bolt.Tx) error {
+		info := tx.Bucket([]byte(dbinfoBucket))
+		if info == nil {
+			return nil
+		}
+
+		err := info.DeleteBucket([]byte(checkpointBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		return nil
+	})
+}
+
+// isConverted reports whether the codec of the key value bucket was already converted.
+// Key value buckets don't have metadata, so the conversion is recorded in the checkpoint.
+func isConverted(tx *bolt.Tx, bucket string) bool {
+	info := tx.Bucket([]byte(dbinfoBucket))
+	if info == nil {
+		return false
+	}
+
+	c := info.Bucket([]byte(checkpointBucket))
+	if c == nil {
+		return false
+	}
+
+	converted := c.Bucket([]byte(checkpointConverted))
+	return converted != nil && converted.Get([]byte(bucket)) != nil
+}
+
+// markConverted records the conversion of the key value bucket in the checkpoint.
+func markConverted(tx *bolt.Tx, bucket string) error {
+	info, err := tx.CreateBucketIfNotExists([]byte(dbinfoBucket))
+	if err != nil {
+		return err
+	}
+
+	c, err := info.CreateBucketIfNotExists([]byte(checkpointBucket))
+	if err != nil {
+		return err
+	}
+
+	converted, err := c.CreateBucketIfNotExists([]byte(checkpointConverted))
+	if err != nil {
+		return err
+	}
+
+	return converted.Put([]byte(bucket), []byte{})
+}
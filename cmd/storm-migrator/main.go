@@ -0,0 +1,402 @@
+// Command storm-migrator migrates Storm databases without writing any Go code.
+//
+// Usage:
+//
+//	storm-migrator inspect --src app.db
+//	storm-migrator plan --src app.db --target 0.6
+//	storm-migrator run --src app.db --dst new.db --codec json --target 0.6
+//	storm-migrator verify --src app.db --dst new.db
+//
+// The buckets created with Set can be given the types of their keys with --kv. The other buckets make run fail,
+// unless --unregistered tells what to do with them: the buckets created with Save or Init can be migrated without their type
+// with --unregistered raw. Results and errors, including the usage errors, are printed in JSON on the standard output.
+// The exit code is 0 on success, 1 if the command failed, 2 if it was misused and 3 if the verification found differences.
+//
+// run stops on SIGINT, SIGTERM or once the --timeout is reached. The destination is removed, unless --resume is given:
+// it is then kept and running the same command again resumes the migration.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	migrator "github.com/asdine/storm-migrator"
+	"github.com/asdine/storm-migrator/v0.5/codec"
+	"github.com/asdine/storm-migrator/v0.5/codec/gob"
+	jsoncodec "github.com/asdine/storm-migrator/v0.5/codec/json"
+	"github.com/asdine/storm-migrator/v0.5/codec/protobuf"
+	"github.com/asdine/storm-migrator/v0.5/codec/sereal"
+)
+
+// Exit codes
+const (
+	exitOK = iota
+	exitFailure
+	exitUsage
+	exitDifferences
+)
+
+var codecs = map[string]codec.MarshalUnmarshaler{
+	"json":     jsoncodec.Codec,
+	"gob":      gob.Codec,
+	"sereal":   sereal.Codec,
+	"protobuf": protobuf.Codec,
+}
+
+// Types the keys of the buckets created with Set can be decoded to
+var keyTypes = map[string]func() interface{}{
+	"int":     func() interface{} { return new(int) },
+	"int64":   func() interface{} { return new(int64) },
+	"uint64":  func() interface{} { return new(uint64) },
+	"float64": func() interface{} { return new(float64) },
+	"string":  func() interface{} { return new(string) },
+	"bool":    func() interface{} { return new(bool) },
+}
+
+var policies = map[string]migrator.UnregisteredPolicy{
+	"raw":  migrator.RawMigrate,
+	"copy": migrator.CopyVerbatim,
+	"skip": migrator.Skip,
+	"fail": migrator.Fail,
+}
+
+const usage = `Usage: storm-migrator <command> [flags]
+
+Commands:
+  inspect  describe the buckets of a database
+  plan     report what run would do
+  run      migrate a database to a new file
+  verify   compare a database with its migrated version
+
+Run storm-migrator <command> -h for the flags of a command.
+`
+
+func main() {
+	// an interrupted migration is rolled back, the destination is kept only with --resume
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run executes the command and returns the exit code.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	cmd := command{stdout: stdout, ctx: ctx}
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return cmd.misuse(errors.New("a command is required"))
+	}
+
+	cmd.name = args[0]
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&cmd.src, "src", "", "path of the source database")
+	fs.StringVar(&cmd.codec, "codec", "json", "codec of the source database: json, gob, sereal or protobuf")
+	fs.Var(&cmd.kv, "kv", "bucket created with Set and the types of its keys, like settings=int,string. Can be repeated")
+
+	var exec func() int
+	switch cmd.name {
+	case "inspect":
+		exec = cmd.inspect
+	case "plan":
+		fs.StringVar(&cmd.target, "target", "", "version to migrate to, the latest by default")
+		fs.BoolVar(&cmd.downgrade, "downgrade", false, "allow migrating to an older version")
+		exec = cmd.plan
+	case "run":
+		fs.StringVar(&cmd.dst, "dst", "", "path of the migrated database")
+		fs.StringVar(&cmd.target, "target", "", "version to migrate to, the latest by default")
+		fs.BoolVar(&cmd.downgrade, "downgrade", false, "allow migrating to an older version")
+		fs.StringVar(&cmd.unregistered, "unregistered", "fail", "what to do with the buckets that are not given with --kv: fail, raw, copy or skip")
+		fs.BoolVar(&cmd.verify, "verify", false, "verify the migrated database")
+		fs.BoolVar(&cmd.resume, "resume", false, "resume an interrupted migration, and keep the destination if it is interrupted again")
+		fs.DurationVar(&cmd.timeout, "timeout", 0, "stop the migration after the given duration, like 10m")
+		exec = cmd.run
+	case "verify":
+		fs.StringVar(&cmd.dst, "dst", "", "path of the migrated database")
+		exec = cmd.verifyDB
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	default:
+		fmt.Fprint(stderr, usage)
+		return cmd.misuse(fmt.Errorf("unknown command %q", cmd.name))
+	}
+
+	// the flag package prints the usage of the command on stderr
+	err := fs.Parse(args[1:])
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	if err != nil {
+		return cmd.misuse(fmt.Errorf("%s: %w", cmd.name, err))
+	}
+
+	if cmd.src == "" {
+		return cmd.misuse(fmt.Errorf("%s: --src is required", cmd.name))
+	}
+
+	if cmd.dst == "" && (cmd.name == "run" || cmd.name == "verify") {
+		return cmd.misuse(fmt.Errorf("%s: --dst is required", cmd.name))
+	}
+
+	if _, ok := codecs[cmd.codec]; !ok {
+		return cmd.misuse(fmt.Errorf("%s: unknown codec %q", cmd.name, cmd.codec))
+	}
+
+	if _, ok := policies[cmd.unregistered]; cmd.name == "run" && !ok {
+		return cmd.misuse(fmt.Errorf("%s: unknown policy %q", cmd.name, cmd.unregistered))
+	}
+
+	return exec()
+}
+
+// command holds the flags of a command.
+type command struct {
+	name         string
+	src, dst     string
+	codec        string
+	kv           kvFlag
+	target       string
+	downgrade    bool
+	unregistered string
+	verify       bool
+	resume       bool
+	timeout      time.Duration
+	stdout       io.Writer
+	ctx          context.Context
+}
+
+// migrator returns a Migrator for the source database, with the buckets given by --kv registered.
+func (c *command) migrator() *migrator.Migrator {
+	m := migrator.New(c.src)
+	for name, keys := range c.kv {
+		m.AddKV(name, keys)
+	}
+	return m
+}
+
+// options returns the options matching the flags.
+func (c *command) options() []func(*migrator.Migrator) error {
+	options := []func(*migrator.Migrator) error{migrator.Codec(codecs[c.codec])}
+	if c.target != "" {
+		options = append(options, migrator.TargetVersion(c.target))
+	}
+	if c.downgrade {
+		options = append(options, migrator.Downgrade())
+	}
+	return options
+}
+
+func (c *command) inspect() int {
+	r, err := c.migrator().Inspect(c.options()...)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	return c.print(r)
+}
+
+func (c *command) plan() int {
+	r, err := c.migrator().Plan(c.options()...)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	return c.print(r)
+}
+
+// runOutput is printed once a migration succeeds.
+type runOutput struct {
+	Source      string                  `json:"source"`
+	Destination string                  `json:"destination"`
+	History     []migrator.HistoryEntry `json:"history"`
+}
+
+func (c *command) run() int {
+	options := append(c.options(), migrator.OnUnregistered(policies[c.unregistered]))
+	if c.verify {
+		options = append(options, migrator.Verify())
+	}
+	if c.resume {
+		options = append(options, migrator.Resume())
+	}
+
+	ctx := c.ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	err := c.migrator().RunContext(ctx, c.dst, options...)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	history, err := migrator.History(c.dst)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	return c.print(runOutput{Source: c.src, Destination: c.dst, History: history})
+}
+
+// verifyDB compares the buckets given by --kv, and the number of records of the other buckets.
+func (c *command) verifyDB() int {
+	m := c.migrator()
+	src, err := m.Inspect(c.options()...)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	r, err := m.Verify(c.dst)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	dst, err := migrator.New(c.dst).Inspect(c.options()...)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	counts := make(map[string]int)
+	for _, b := range dst.Buckets {
+		counts[b.Name] = b.Records
+	}
+
+	for _, b := range src.Buckets {
+		if _, ok := c.kv[b.Name]; ok {
+			continue
+		}
+
+		r.Buckets = append(r.Buckets, migrator.BucketDiff{
+			Name:             b.Name,
+			Kind:             b.Kind,
+			SourceCount:      b.Records,
+			DestinationCount: counts[b.Name],
+		})
+	}
+
+	code := c.print(r)
+	if code == exitOK && !r.OK() {
+		return exitDifferences
+	}
+	return code
+}
+
+// errorOutput is printed when a command fails.
+type errorOutput struct {
+	Error string `json:"error"`
+	// Details given by a *migrator.Error
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Type   string `json:"type,omitempty"`
+	// Kinds of the unregistered buckets, by bucket name
+	Unregistered map[string]string `json:"unregistered,omitempty"`
+	// Differences found by the --verify flag
+	Verify *migrator.VerifyReport `json:"verify,omitempty"`
+	// Set if the migration was interrupted and the destination can be resumed with --resume
+	Resumable bool `json:"resumable,omitempty"`
+}
+
+// fail prints the error and returns the matching exit code.
+func (c *command) fail(err error) int {
+	out := errorOutput{Error: err.Error()}
+
+	var merr *migrator.Error
+	if errors.As(err, &merr) {
+		out.From, out.To, out.Bucket = merr.From, merr.To, merr.Bucket
+		if merr.Key != nil {
+			out.Key = fmt.Sprintf("%q", merr.Key)
+		}
+		if merr.Type != nil {
+			out.Type = merr.Type.String()
+		}
+	}
+
+	var ierr *migrator.InterruptedError
+	if errors.As(err, &ierr) {
+		out.From, out.To, out.Bucket = ierr.From, ierr.To, ierr.Bucket
+		out.Resumable = ierr.Resumable
+	}
+
+	var uerr *migrator.UnregisteredBucketsError
+	if errors.As(err, &uerr) {
+		out.Unregistered = uerr.Buckets
+	}
+
+	code := exitFailure
+	var verr *migrator.VerificationError
+	if errors.As(err, &verr) {
+		out.Verify = verr.Report
+		code = exitDifferences
+	}
+
+	if c.print(out) != exitOK {
+		return exitFailure
+	}
+	return code
+}
+
+// misuse prints the error in JSON, like the errors of the commands, and returns exitUsage.
+func (c *command) misuse(err error) int {
+	if c.print(errorOutput{Error: err.Error()}) != exitOK {
+		return exitFailure
+	}
+	return exitUsage
+}
+
+// print writes v in JSON on the standard output.
+func (c *command) print(v interface{}) int {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	if enc.Encode(v) != nil {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// kvFlag collects the buckets given with --kv and the types of their keys.
+type kvFlag map[string][]interface{}
+
+func (f kvFlag) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (f *kvFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("expected bucket=type[,type...], got %q", s)
+	}
+
+	if *f == nil {
+		*f = make(kvFlag)
+	}
+
+	name := s[:i]
+	for _, typ := range strings.Split(s[i+1:], ",") {
+		fn, ok := keyTypes[typ]
+		if !ok {
+			return fmt.Errorf("unknown key type %q", typ)
+		}
+		(*f)[name] = append((*f)[name], fn())
+	}
+	return nil
+}
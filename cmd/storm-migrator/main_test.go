@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/stretchr/testify/require"
+)
+
+type User struct {
+	ID   int
+	Name string `storm:"index"`
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "storm-migrator")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "v04.db")
+	dst := filepath.Join(dir, "v06.db")
+
+	db, err := stormv04.Open(src)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = db.Save(&User{ID: i + 1, Name: fmt.Sprintf("name%d", i%2)})
+		require.NoError(t, err)
+		err = db.Set("settings", i, fmt.Sprintf("value%d", i))
+		require.NoError(t, err)
+	}
+	db.Close()
+
+	exec := func(args ...string) (int, []byte) {
+		var stdout, stderr bytes.Buffer
+		code := run(context.Background(), args, &stdout, &stderr)
+		return code, stdout.Bytes()
+	}
+
+	misuse := func(args ...string) string {
+		code, out := exec(args...)
+		require.Equal(t, exitUsage, code)
+		var e errorOutput
+		require.NoError(t, json.Unmarshal(out, &e))
+		return e.Error
+	}
+
+	require.Equal(t, "a command is required", misuse())
+	require.Equal(t, `unknown command "unknown"`, misuse("unknown"))
+	require.Equal(t, "run: --dst is required", misuse("run", "--src", src))
+	require.Equal(t, `plan: unknown codec "xml"`, misuse("plan", "--src", src, "--codec", "xml"))
+	require.Equal(t, `run: unknown policy "all"`, misuse("run", "--src", src, "--dst", dst, "--unregistered", "all"))
+	require.Contains(t, misuse("inspect", "--src", src, "--kv", "settings"), "invalid value")
+
+	code, out := exec("inspect", "--src", src, "--kv", "settings=int")
+	require.Equal(t, exitOK, code)
+	var r migrator.Report
+	require.NoError(t, json.Unmarshal(out, &r))
+	require.Equal(t, "0.4.1", r.Version)
+	require.Len(t, r.Buckets, 2)
+	require.Equal(t, "settings", r.Buckets[0].Name)
+	require.Equal(t, migrator.KVBucket, r.Buckets[0].Kind)
+	require.Equal(t, "User", r.Buckets[1].Name)
+	require.Equal(t, migrator.TypeBucket, r.Buckets[1].Kind)
+	require.Equal(t, 5, r.Buckets[1].Records)
+	require.Equal(t, []string{"Name"}, r.Buckets[1].Indexes)
+
+	code, out = exec("plan", "--src", src, "--target", "0.5")
+	require.Equal(t, exitOK, code)
+	r = migrator.Report{}
+	require.NoError(t, json.Unmarshal(out, &r))
+	require.Equal(t, []migrator.StepReport{{From: "0.4", To: "0.5"}}, r.Steps)
+
+	// the unregistered buckets make the migration fail by default
+	code, out = exec("run", "--src", src, "--dst", dst)
+	require.Equal(t, exitFailure, code)
+	var e errorOutput
+	require.NoError(t, json.Unmarshal(out, &e))
+	require.Equal(t, map[string]string{"User": migrator.TypeBucket, "settings": migrator.KVBucket}, e.Unregistered)
+	_, err = os.Stat(dst)
+	require.True(t, os.IsNotExist(err))
+
+	code, out = exec("run", "--src", src, "--dst", dst, "--unregistered", "raw", "--timeout", "1ns")
+	require.Equal(t, exitFailure, code)
+	e = errorOutput{}
+	require.NoError(t, json.Unmarshal(out, &e))
+	require.Contains(t, e.Error, "context deadline exceeded")
+	require.False(t, e.Resumable)
+	_, err = os.Stat(dst)
+	require.True(t, os.IsNotExist(err))
+
+	code, out = exec("run", "--src", src, "--dst", dst, "--codec", "json", "--target", "0.6", "--kv", "settings=int", "--unregistered", "raw")
+	require.Equal(t, exitOK, code, string(out))
+	var ro runOutput
+	require.NoError(t, json.Unmarshal(out, &ro))
+	require.Len(t, ro.History, 2)
+
+	code, out = exec("verify", "--src", src, "--dst", dst, "--kv", "settings=int")
+	require.Equal(t, exitOK, code, string(out))
+
+	code, _ = exec("run", "--src", src, "--dst", dst)
+	require.Equal(t, exitFailure, code)
+
+	db6, err := stormv06.Open(dst)
+	require.NoError(t, err)
+	var users []User
+	err = db6.Find("Name", "name0", &users)
+	require.NoError(t, err)
+	require.Len(t, users, 3)
+
+	var v string
+	err = db6.Get("settings", 3, &v)
+	require.NoError(t, err)
+	require.Equal(t, "value3", v)
+
+	// the verification finds the removed record
+	err = db6.DeleteStruct(&users[0])
+	require.NoError(t, err)
+	db6.Close()
+
+	code, _ = exec("verify", "--src", src, "--dst", dst, "--kv", "settings=int")
+	require.Equal(t, exitDifferences, code)
+}
@@ -0,0 +1,209 @@
+package migrator
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/asdine/storm-migrator/v0.5/codec"
+	"github.com/asdine/storm-migrator/v0.5/codec/gob"
+	"github.com/asdine/storm-migrator/v0.5/codec/json"
+	"github.com/asdine/storm-migrator/v0.5/codec/protobuf"
+	"github.com/asdine/storm-migrator/v0.5/codec/sereal"
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+)
+
+// Number of records decoded when detecting the codec of a bucket
+const detectSampleSize = 10
+
+// Codecs tried when detecting the codec of a bucket
+var builtinCodecs = []codec.MarshalUnmarshaler{gob.Codec, json.Codec, sereal.Codec, protobuf.Codec}
+
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// AddBucketsWithCodec registers buckets to migrate, like AddBuckets, whose records are encoded
+// with the given codec instead of the one set with the Codec option.
+// The codec only applies to the top level buckets, not to the ones of the same name registered with AddBucketsAt.
+func (m *Migrator) AddBucketsWithCodec(c codec.MarshalUnmarshaler, instances ...interface{}) {
+	for _, inst := range instances {
+		m.codecs[bucketName(inst)] = c
+	}
+
+	m.AddBuckets(instances...)
+}
+
+// DetectCodecs option detects the codec of the buckets registered with AddBuckets before migrating them.
+// A CodecDetected event is emitted for every bucket.
+func DetectCodecs() func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.detect = true
+		return nil
+	}
+}
+
+// DetectCodecs detects the codec of the buckets registered with AddBuckets and returns the name of the codec
+// chosen for each of them. The detected codecs are used by the next calls to Run and Verify.
+// The codec stored in the metadata of the bucket is used when there is one, otherwise a sample of the records
+// is decoded with each of the built-in codecs: gob, json, sereal and protobuf.
+// If several of them can decode the sample, an *AmbiguousCodecError is returned, register the bucket
+// with AddBucketsWithCodec to lift the ambiguity. Buckets registered with AddBucketsWithCodec and empty buckets
+// keep their codec.
+func (m *Migrator) DetectCodecs() (map[string]string, error) {
+	b, err := openSource(m.path)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	detected, err := m.detectCodecs(b)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, c := range detected {
+		m.codecs[name] = c
+	}
+
+	names := make(map[string]string)
+	for _, inst := range m.instances {
+		name := bucketName(inst)
+		names[name] = m.codecOf(name).Name()
+	}
+
+	return names, nil
+}
+
+// detectSourceCodecs detects the codecs of the source database and emits an event for each bucket.
+func (m *Migrator) detectSourceCodecs() error {
+	names, err := m.DetectCodecs()
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range m.instances {
+		name := bucketName(inst)
+		m.emit(Event{Type: CodecDetected, Bucket: name, Codec: names[name]})
+	}
+
+	return nil
+}
+
+// detectCodecs returns the codecs detected for the registered buckets that were not registered with a codec.
+func (m *Migrator) detectCodecs(b *bolt.DB) (map[string]codec.MarshalUnmarshaler, error) {
+	detected := make(map[string]codec.MarshalUnmarshaler)
+
+	err := b.View(func(tx *bolt.Tx) error {
+		for _, inst := range m.instances {
+			typ := reflect.Indirect(reflect.ValueOf(inst)).Type()
+			if _, ok := m.codecs[typ.Name()]; ok {
+				continue
+			}
+
+			bucket := tx.Bucket([]byte(m.sourceName(typ.Name())))
+			if bucket == nil {
+				continue
+			}
+
+			c, err := detectCodec(bucket, typ)
+			if err != nil {
+				return err
+			}
+
+			if c != nil {
+				detected[typ.Name()] = c
+			}
+		}
+
+		return nil
+	})
+
+	return detected, err
+}
+
+// detectCodec returns the codec used by the records of the bucket, or nil if the bucket is empty.
+func detectCodec(bucket *bolt.Bucket, typ reflect.Type) (codec.MarshalUnmarshaler, error) {
+	if meta := bucket.Bucket([]byte(metadataBucket)); meta != nil {
+		if c := builtinCodec(string(meta.Get([]byte("codec")))); c != nil {
+			return c, nil
+		}
+	}
+
+	var sample [][]byte
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil && len(sample) < detectSampleSize; k, v = cursor.Next() {
+		if v != nil {
+			sample = append(sample, v)
+		}
+	}
+
+	if len(sample) == 0 {
+		return nil, nil
+	}
+
+	var found []codec.MarshalUnmarshaler
+	for _, c := range builtinCodecs {
+		// the protobuf codec falls back to json for the types that are not messages
+		if c == protobuf.Codec && !reflect.PtrTo(typ).Implements(protoMessageType) {
+			continue
+		}
+
+		if decodesAll(c, typ, sample) {
+			found = append(found, c)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%w: bucket %s", ErrUnknownCodec, typ.Name())
+	case 1:
+		return found[0], nil
+	}
+
+	names := make([]string, len(found))
+	for i, c := range found {
+		names[i] = c.Name()
+	}
+
+	return nil, &AmbiguousCodecError{Bucket: typ.Name(), Codecs: names}
+}
+
+// decodesAll reports whether the codec can decode every value of the sample.
+func decodesAll(c codec.MarshalUnmarshaler, typ reflect.Type, sample [][]byte) bool {
+	for _, v := range sample {
+		if c.Unmarshal(v, reflect.New(typ).Interface()) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// builtinCodec returns the built-in codec with the given name, or nil.
+func builtinCodec(name string) codec.MarshalUnmarshaler {
+	for _, c := range builtinCodecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// codecOf returns the codec used by the records of the top level bucket in the source database.
+func (m *Migrator) codecOf(bucketName string) codec.MarshalUnmarshaler {
+	if c, ok := m.codecs[bucketName]; ok {
+		return c
+	}
+
+	return m.forceCodec
+}
+
+// codecAt returns the codec used by the records of the bucket nested under the given path in the source database.
+// The codecs registered by bucket name only apply to the top level buckets.
+func (m *Migrator) codecAt(path []string, bucketName string) codec.MarshalUnmarshaler {
+	if len(path) > 0 {
+		return m.forceCodec
+	}
+
+	return m.codecOf(bucketName)
+}
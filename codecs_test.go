@@ -0,0 +1,180 @@
+package migrator_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	gobv04 "github.com/asdine/storm-migrator/v0.4/codec/gob"
+	serealv04 "github.com/asdine/storm-migrator/v0.4/codec/sereal"
+	"github.com/asdine/storm-migrator/v0.5/codec/gob"
+	"github.com/asdine/storm-migrator/v0.5/codec/sereal"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+func prepareMixedDB(t *testing.T) (string, string, func()) {
+	dir, path, cleanup := prepareDB(t)
+
+	// the version is stored with the default codec, skip its check
+	b, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	defer b.Close()
+
+	dbv04, err := stormv04.Open("", stormv04.UseDB(b), stormv04.Codec(gobv04.Codec))
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = dbv04.Save(&Indexed{ID: i + 1, Name: fmt.Sprintf("name%d", i%2)})
+		require.NoError(t, err)
+	}
+
+	dbv04, err = stormv04.Open("", stormv04.UseDB(b), stormv04.Codec(serealv04.Codec))
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = dbv04.Save(&StringID{ID: fmt.Sprint(i + 100), Code: i + 100})
+		require.NoError(t, err)
+	}
+
+	return dir, path, cleanup
+}
+
+func TestAddBucketsWithCodec(t *testing.T) {
+	dir, path, cleanup := prepareMixedDB(t)
+	defer cleanup()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddBucketsWithCodec(gob.Codec, new(Indexed))
+	m.AddBucketsWithCodec(sereal.Codec, new(StringID))
+	err := m.Run(filepath.Join(dir, "v06.db"), migrator.Verify())
+	require.NoError(t, err)
+
+	b, err := bolt.Open(filepath.Join(dir, "v06.db"), 0600, nil)
+	require.NoError(t, err)
+
+	db, err := stormv06.Open("", stormv06.UseDB(b), stormv06.Codec(gob.Codec))
+	require.NoError(t, err)
+
+	var list []Indexed
+	err = db.Find("Name", "name0", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+
+	db, err = stormv06.Open("", stormv06.UseDB(b), stormv06.Codec(sereal.Codec))
+	require.NoError(t, err)
+
+	var s StringID
+	err = db.One("ID", "102", &s)
+	require.NoError(t, err)
+	require.Equal(t, 102, s.Code)
+	b.Close()
+
+	// the downgrade steps use the codec of each bucket as well
+	m = migrator.New(filepath.Join(dir, "v06.db"))
+	m.AddBuckets(new(A), new(B))
+	m.AddBucketsWithCodec(gob.Codec, new(Indexed))
+	m.AddBucketsWithCodec(sereal.Codec, new(StringID))
+	err = m.Run(filepath.Join(dir, "old.db"), migrator.TargetVersion("0.4"), migrator.Downgrade(), migrator.Verify())
+	require.NoError(t, err)
+
+	b, err = bolt.Open(filepath.Join(dir, "old.db"), 0600, nil)
+	require.NoError(t, err)
+	defer b.Close()
+
+	dbv04, err := stormv04.Open("", stormv04.UseDB(b), stormv04.Codec(gobv04.Codec))
+	require.NoError(t, err)
+	err = dbv04.Find("Name", "name0", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+
+	dbv04, err = stormv04.Open("", stormv04.UseDB(b), stormv04.Codec(serealv04.Codec))
+	require.NoError(t, err)
+	err = dbv04.One("ID", "102", &s)
+	require.NoError(t, err)
+	require.Equal(t, 102, s.Code)
+}
+
+func TestAddBucketsWithCodecNested(t *testing.T) {
+	dir, path, cleanup := prepareMixedDB(t)
+	defer cleanup()
+
+	// the nested bucket of the same name uses the default codec
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		err = dbv04.From("users").Save(&Indexed{ID: i + 1, Name: fmt.Sprintf("nested%d", i%2)})
+		require.NoError(t, err)
+	}
+	dbv04.Close()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddBucketsWithCodec(gob.Codec, new(Indexed))
+	m.AddBucketsWithCodec(sereal.Codec, new(StringID))
+	m.AddBucketsAt([]string{"users"}, new(Indexed))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.Verify())
+	require.NoError(t, err)
+
+	db, err := stormv06.Open(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var list []Indexed
+	err = db.From("users").Find("Name", "nested1", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+}
+
+func TestDetectCodecs(t *testing.T) {
+	dir, path, cleanup := prepareMixedDB(t)
+	defer cleanup()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B), new(Indexed), new(StringID), new(Untyped))
+	codecs, err := m.DetectCodecs()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"A":        "json",
+		"B":        "json",
+		"Indexed":  "gob",
+		"StringID": "sereal",
+		"Untyped":  "json",
+	}, codecs)
+
+	detected := make(map[string]string)
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B), new(Indexed), new(StringID))
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.DetectCodecs(), migrator.Verify(), migrator.OnEvent(func(e migrator.Event) {
+		if e.Type == migrator.CodecDetected {
+			detected[e.Bucket] = e.Codec
+		}
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "gob", detected["Indexed"])
+	require.Equal(t, "sereal", detected["StringID"])
+
+	// the codecs of a migrated database are read from the metadata
+	m = migrator.New(filepath.Join(dir, "v06.db"))
+	m.AddBuckets(new(A), new(Indexed), new(StringID))
+	codecs, err = m.DetectCodecs()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"A": "json", "Indexed": "gob", "StringID": "sereal"}, codecs)
+
+	b, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	err = b.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("B")).Put([]byte{0}, []byte{0xff, 0x00})
+	})
+	require.NoError(t, err)
+	b.Close()
+
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	_, err = m.DetectCodecs()
+	require.True(t, errors.Is(err, migrator.ErrUnknownCodec))
+}
@@ -0,0 +1,348 @@
+package migrator
+
+import (
+	"errors"
+	"reflect"
+
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	stormv05 "github.com/asdine/storm-migrator/v0.5"
+	"github.com/asdine/storm-migrator/v0.5/codec"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+)
+
+// ConvertCodec option converts the database from one codec to another once it is migrated.
+// The records of the buckets registered with AddBuckets and the values of the buckets registered
+// with AddKV or AddKVFunc are decoded with from and encoded with to. Keys and indexed values encoded by the codec
+// are converted as well and the name of the codec stored in the metadata of each bucket is updated.
+// The from codec is used for the migration itself, as with the Codec option.
+// The types of the values of every key value bucket must be registered with AddKVValues,
+// and buckets registered with AddBucketsAt or AddKVAt can't be converted.
+func ConvertCodec(from, to codec.MarshalUnmarshaler) func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.forceCodec = from
+		m.convertTo = to
+		return nil
+	}
+}
+
+// AddKVValues registers the types of the values of a bucket created using Set, tried in order when decoding them.
+// It is required when converting the codec, and when dumping a bucket whose codec can't decode them in an interface{}.
+// Values are otherwise decoded in an interface{}.
+func (m *Migrator) AddKVValues(bucketName string, valueInstances []interface{}) {
+	m.kvValues[bucketName] = append(m.kvValues[bucketName], valueInstances...)
+}
+
+// dstCodec returns the codec used by the bucket in the migrated database.
+func (m *Migrator) dstCodec(bucketName string) codec.MarshalUnmarshaler {
+	if m.convertTo != nil {
+		return m.convertTo
+	}
+
+	return m.codecOf(bucketName)
+}
+
+// dstCodecAt returns the codec used by the bucket nested under the given path in the migrated database.
+func (m *Migrator) dstCodecAt(path []string, bucketName string) codec.MarshalUnmarshaler {
+	if len(path) > 0 {
+		return m.codecAt(path, bucketName)
+	}
+
+	return m.dstCodec(bucketName)
+}
+
+var (
+	errNestedConvert = errors.New("buckets registered with AddBucketsAt or AddKVAt can't be converted to another codec")
+	errNoKVValues    = errors.New("the types of the values must be registered with AddKVValues to convert the codec")
+)
+
+// checkConvert makes sure every registered bucket can be converted before anything is written.
+// Values decoded in an interface{} would not be encoded back the same way, numbers becoming floats for example.
+func (m *Migrator) checkConvert() error {
+	if m.convertTo == nil {
+		return nil
+	}
+
+	if len(m.nodes) > 0 {
+		return errNestedConvert
+	}
+
+	for _, name := range m.kvBuckets() {
+		if len(m.kvValues[name]) == 0 {
+			return &Error{Bucket: name, Err: errNoKVValues}
+		}
+	}
+
+	return nil
+}
+
+// convertCodec converts every registered bucket from the source codec to the destination codec,
+// each bucket in its own transaction. Buckets that already use the destination codec are skipped.
+func (m *Migrator) convertCodec(b *bolt.DB) error {
+	version, err := m.getVersion(b)
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range m.instances {
+		err = b.Update(func(tx *bolt.Tx) error {
+			return m.convertType(tx, version, inst)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range m.kvBuckets() {
+		err = b.Update(func(tx *bolt.Tx) error {
+			return m.convertKV(tx, version, name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{dbinfoBucket, metadataBucket} {
+			err := m.convertValue(tx.Bucket([]byte(name)), []byte("version"), new(string))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// convertType saves the records of the bucket using the destination codec,
+// unless it was already converted.
+func (m *Migrator) convertType(tx *bolt.Tx, version string, inst interface{}) error {
+	name := bucketName(inst)
+
+	bucket := tx.Bucket([]byte(name))
+	if bucket == nil || m.converted(bucket) {
+		return nil
+	}
+
+	return m.resaveType(tx, version, inst, m.codecOf(name), m.convertTo)
+}
+
+// resaveType decodes all the records of the bucket, drops it and saves the records back
+// using the given codec. The metadata and the sequence of the bucket are kept.
+func (m *Migrator) resaveType(tx *bolt.Tx, version string, inst interface{}, from, to codec.MarshalUnmarshaler) error {
+	typ := reflect.Indirect(reflect.ValueOf(inst)).Type()
+	name := typ.Name()
+
+	bucket := tx.Bucket([]byte(name))
+	if bucket == nil {
+		return nil
+	}
+
+	var records []reflect.Value
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		record := reflect.New(typ)
+		err := from.Unmarshal(v, record.Interface())
+		if err != nil {
+			return &Error{Bucket: name, Key: append([]byte(nil), k...), Type: typ, Err: err}
+		}
+
+		records = append(records, record)
+		return nil
+	})
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	seq := bucket.Sequence()
+	meta := make(map[string][]byte)
+	if mb := bucket.Bucket([]byte(metadataBucket)); mb != nil {
+		err = mb.ForEach(func(k, v []byte) error {
+			if v != nil && string(k) != "codec" {
+				meta[string(k)] = append([]byte(nil), v...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.DeleteBucket([]byte(name))
+	if err != nil {
+		return err
+	}
+
+	save, err := saver(tx, version, to)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		err = save(record.Interface())
+		if err != nil {
+			return err
+		}
+	}
+
+	bucket = tx.Bucket([]byte(name))
+	err = bucket.SetSequence(seq)
+	if err != nil {
+		return err
+	}
+
+	if mb := bucket.Bucket([]byte(metadataBucket)); mb != nil {
+		for k, v := range meta {
+			err = mb.Put([]byte(k), v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// saver returns a function that saves a record with the given codec,
+// using the version of Storm the database is at.
+func saver(tx *bolt.Tx, version string, c codec.MarshalUnmarshaler) (func(interface{}) error, error) {
+	switch {
+	case compareVersions(version, "0.6") >= 0:
+		db, err := stormv06.Open("", stormv06.UseDB(tx.DB()), stormv06.Codec(c))
+		if err != nil {
+			return nil, err
+		}
+		return db.WithTransaction(tx).Save, nil
+	case compareVersions(version, "0.5") >= 0:
+		db, err := stormv05.Open("", stormv05.UseDB(tx.DB()), stormv05.Codec(c))
+		if err != nil {
+			return nil, err
+		}
+		return db.WithTransaction(tx).Save, nil
+	default:
+		db, err := stormv04.Open("", stormv04.UseDB(tx.DB()), stormv04.Codec(encodeDecoder{c}))
+		if err != nil {
+			return nil, err
+		}
+		return db.WithTransaction(tx).Save, nil
+	}
+}
+
+// convertKV converts the keys encoded by the codec and all the values of a key value bucket,
+// and updates the name of the codec stored in its metadata. Keys that can't be decoded are kept as is.
+// The conversion is recorded in the checkpoint so that it is not done twice when resuming.
+func (m *Migrator) convertKV(tx *bolt.Tx, version string, name string) error {
+	bucket := tx.Bucket([]byte(name))
+	if bucket == nil || isConverted(tx, name) {
+		return nil
+	}
+
+	var keys, newKeys, values [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		newKey := k
+		if key, ok := m.decodeKVKey(version, name, k); ok {
+			var err error
+			newKey, err = encodeKey(version, key, m.convertTo)
+			if err != nil {
+				return err
+			}
+		}
+
+		value, err := m.decodeKVValue(name, v, m.forceCodec)
+		if err != nil {
+			return &Error{Bucket: name, Key: append([]byte(nil), k...), Err: err}
+		}
+
+		raw, err := m.convertTo.Marshal(value)
+		if err != nil {
+			return &Error{Bucket: name, Key: append([]byte(nil), k...), Err: err}
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+		newKeys = append(newKeys, append([]byte(nil), newKey...))
+		values = append(values, raw)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		err = bucket.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, k := range newKeys {
+		err = bucket.Put(k, values[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Storm refuses to write in a bucket whose metadata references another codec
+	if mb := bucket.Bucket([]byte(metadataBucket)); mb != nil && mb.Get([]byte("codec")) != nil {
+		err = mb.Put([]byte("codec"), []byte(m.convertTo.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return markConverted(tx, name)
+}
+
+// decodeKVValue decodes a value using the first instance registered with AddKVValues that matches,
+// or in an interface{} if none was registered.
+func (m *Migrator) decodeKVValue(name string, v []byte, c codec.MarshalUnmarshaler) (interface{}, error) {
+	instances := m.kvValues[name]
+	if len(instances) == 0 {
+		var value interface{}
+		err := c.Unmarshal(v, &value)
+		return value, err
+	}
+
+	var err error
+	for _, inst := range instances {
+		value := reflect.New(reflect.Indirect(reflect.ValueOf(inst)).Type())
+		err = c.Unmarshal(v, value.Interface())
+		if err == nil {
+			return value.Elem().Interface(), nil
+		}
+	}
+
+	return nil, err
+}
+
+// convertValue converts a single value of a bucket.
+func (m *Migrator) convertValue(bucket *bolt.Bucket, key []byte, to interface{}) error {
+	if bucket == nil {
+		return nil
+	}
+
+	raw := bucket.Get(key)
+	if raw == nil || m.forceCodec.Unmarshal(raw, to) != nil {
+		return nil
+	}
+
+	raw, err := m.convertTo.Marshal(reflect.ValueOf(to).Elem().Interface())
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, raw)
+}
+
+// converted reports whether the metadata of the bucket already references the destination codec.
+// It is used for the buckets of the registered types.
+func (m *Migrator) converted(bucket *bolt.Bucket) bool {
+	mb := bucket.Bucket([]byte(metadataBucket))
+	return mb != nil && string(mb.Get([]byte("codec"))) == m.convertTo.Name()
+}
@@ -0,0 +1,166 @@
+package migrator_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	"github.com/asdine/storm-migrator/v0.5/codec/gob"
+	"github.com/asdine/storm-migrator/v0.5/codec/json"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertCodec(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = dbv04.Save(&Indexed{ID: i + 1, Name: fmt.Sprintf("name%d", i%2)})
+		require.NoError(t, err)
+	}
+	dbv04.Close()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B), new(Indexed))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	m.AddKVValues("bucket", []interface{}{new(int), new(A)})
+	err = m.Run(filepath.Join(dir, "gob.db"), migrator.ConvertCodec(json.Codec, gob.Codec), migrator.Verify())
+	require.NoError(t, err)
+
+	db, err := stormv06.Open(filepath.Join(dir, "gob.db"), stormv06.Codec(gob.Codec))
+	require.NoError(t, err)
+
+	var version string
+	err = db.Get("__storm_db", "version", &version)
+	require.NoError(t, err)
+	require.Equal(t, stormv06.Version, version)
+
+	for i := 0; i < 10; i++ {
+		var a A
+		err = db.One("ID", i+1, &a)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("Field%d", i), a.Field1)
+
+		var b B
+		err = db.One("ID", strconv.Itoa(i+1), &b)
+		require.NoError(t, err)
+		require.Equal(t, int64(i*10), b.Field1)
+	}
+
+	var list []Indexed
+	err = db.Find("Name", "name1", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	var v int
+	err = db.Get("bucket", "string0", &v)
+	require.NoError(t, err)
+	var a A
+	err = db.Get("bucket", 13, &a)
+	require.NoError(t, err)
+	require.Equal(t, 13, a.ID)
+
+	// the key value buckets can still be written with the new codec
+	err = db.Set("bucket", "new", 42)
+	require.NoError(t, err)
+
+	err = db.Bolt.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{"A", "B", "Indexed", "bucket"} {
+			meta := tx.Bucket([]byte(name)).Bucket([]byte("__storm_metadata"))
+			require.Equal(t, "gob", string(meta.Get([]byte("codec"))))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.Close()
+
+	// and back to json
+	m = migrator.New(filepath.Join(dir, "gob.db"))
+	m.AddBuckets(new(A), new(B), new(Indexed))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	m.AddKVValues("bucket", []interface{}{new(int), new(A)})
+	err = m.Run(filepath.Join(dir, "json.db"), migrator.ConvertCodec(gob.Codec, json.Codec), migrator.Verify())
+	require.NoError(t, err)
+
+	db, err = stormv06.Open(filepath.Join(dir, "json.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.One("ID", 3, &a)
+	require.NoError(t, err)
+	err = db.Find("Name", "name0", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+}
+
+func TestConvertCodecUnsupported(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	// the values would be decoded in an interface{}
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err := m.Run(filepath.Join(dir, "gob.db"), migrator.ConvertCodec(json.Codec, gob.Codec))
+	require.Error(t, err)
+	var merr *migrator.Error
+	require.True(t, errors.As(err, &merr))
+	require.Equal(t, "bucket", merr.Bucket)
+	require.Contains(t, err.Error(), "AddKVValues")
+	_, err = os.Stat(filepath.Join(dir, "gob.db"))
+	require.True(t, os.IsNotExist(err))
+
+	// nested buckets are not converted
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	m.AddKVValues("bucket", []interface{}{new(int), new(A)})
+	m.AddBucketsAt([]string{"tenants", migrator.Wildcard}, new(A))
+	err = m.Run(filepath.Join(dir, "gob.db"), migrator.ConvertCodec(json.Codec, gob.Codec))
+	require.EqualError(t, err, "buckets registered with AddBucketsAt or AddKVAt can't be converted to another codec")
+	_, err = os.Stat(filepath.Join(dir, "gob.db"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestConvertCodecKV(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "storm-migrator")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := stormv06.Open(filepath.Join(dir, "json.db"))
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = db.Set("settings", i, fmt.Sprintf("value%d", i))
+		require.NoError(t, err)
+	}
+	db.Close()
+
+	m := migrator.New(filepath.Join(dir, "json.db"))
+	m.AddKV("settings", []interface{}{new(int)})
+	m.AddKVValues("settings", []interface{}{new(string)})
+	err = m.Run(filepath.Join(dir, "gob.db"), migrator.ConvertCodec(json.Codec, gob.Codec), migrator.Verify())
+	require.NoError(t, err)
+
+	db, err = stormv06.Open(filepath.Join(dir, "gob.db"), stormv06.Codec(gob.Codec))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var v string
+	err = db.Get("settings", 3, &v)
+	require.NoError(t, err)
+	require.Equal(t, "value3", v)
+
+	// the metadata of the bucket references the new codec
+	err = db.Set("settings", 5, "value5")
+	require.NoError(t, err)
+}
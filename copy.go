@@ -0,0 +1,179 @@
+package migrator
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Maximum size of the data written in a single transaction while compacting
+const compactTxSize = 64 << 20
+
+// copyDB copies the source to the given path, compacting it if required.
+func (m *Migrator) copyDB(path string) error {
+	if m.compact {
+		return compactDB(m.path, path)
+	}
+
+	return snapshotDB(m.path, path)
+}
+
+// snapshotDB copies the database from a read-only transaction so the copy is consistent
+// even if another process is writing to the source.
+func snapshotDB(src, dst string) error {
+	db, err := openSource(src)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: %s", ErrDestinationExists, dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// don't leave a partial copy behind
+		os.Remove(dst)
+		return err
+	}
+
+	return nil
+}
+
+// compactDB rewrites every bucket of the source, including the nested ones and their sequences,
+// into a new database.
+func compactDB(src, dst string) error {
+	_, err := os.Stat(dst)
+	if err == nil {
+		return fmt.Errorf("%w: %s", ErrDestinationExists, dst)
+	}
+
+	s, err := openSource(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d, err := bolt.Open(dst, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	err = s.View(func(stx *bolt.Tx) error {
+		return writeCompacted(stx, d)
+	})
+
+	cerr := d.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// don't leave a partial copy behind
+		os.Remove(dst)
+		return err
+	}
+
+	return nil
+}
+
+func writeCompacted(src *bolt.Tx, d *bolt.DB) error {
+	tx, err := d.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	var size int
+	err = walkBuckets(src, func(path [][]byte, k, v []byte, seq uint64) error {
+		// commit regularly to keep the transactions small
+		if size+len(k)+len(v) > compactTxSize {
+			err := tx.Commit()
+			if err != nil {
+				return err
+			}
+
+			tx, err = d.Begin(true)
+			if err != nil {
+				return err
+			}
+			size = 0
+		}
+		size += len(k) + len(v)
+
+		if len(path) == 0 {
+			b, err := tx.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return b.SetSequence(seq)
+		}
+
+		b := tx.Bucket(path[0])
+		for _, name := range path[1:] {
+			b = b.Bucket(name)
+		}
+
+		if v != nil {
+			return b.Put(k, v)
+		}
+
+		nb, err := b.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return nb.SetSequence(seq)
+	})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// walkBuckets calls fn for every bucket and every key of the database, parents first.
+// For buckets, v is nil and seq is the sequence of the bucket.
+func walkBuckets(tx *bolt.Tx, fn func(path [][]byte, k, v []byte, seq uint64) error) error {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		err := fn(nil, name, nil, b.Sequence())
+		if err != nil {
+			return err
+		}
+
+		return walkBucket(b, [][]byte{name}, fn)
+	})
+}
+
+func walkBucket(b *bolt.Bucket, path [][]byte, fn func(path [][]byte, k, v []byte, seq uint64) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return fn(path, k, v, 0)
+		}
+
+		nb := b.Bucket(k)
+		err := fn(path, k, nil, nb.Sequence())
+		if err != nil {
+			return err
+		}
+
+		return walkBucket(nb, append(path[:len(path):len(path)], k), fn)
+	})
+}
@@ -0,0 +1,691 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/asdine/storm-migrator/v0.5/codec"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+)
+
+// Entries of a dump
+const (
+	// DumpHeader is the first line of a dump, it describes the database
+	DumpHeader = "header"
+	// DumpBucket starts the records of a bucket
+	DumpBucket = "bucket"
+	// DumpRecord is a record of a bucket created with Save, or a key value pair of a bucket created with Set
+	DumpRecord = "record"
+)
+
+// Types of the keys of a dump
+const (
+	KeyInt    = "int"
+	KeyString = "string"
+	KeyBytes  = "bytes"
+)
+
+// DumpEntry is a line of a dump.
+type DumpEntry struct {
+	// DumpHeader, DumpBucket or DumpRecord
+	Entry string `json:"entry"`
+	// Version of Storm of the dumped database, for the header
+	Version string `json:"version,omitempty"`
+	// Name of the codec of the database, or of the bucket
+	Codec string `json:"codec,omitempty"`
+	// Path of the bucket, for the buckets and the records
+	Path []string `json:"path,omitempty"`
+	// TypeBucket or KVBucket, for the buckets
+	Kind string `json:"kind,omitempty"`
+	// Indexes of the bucket
+	Indexes []DumpIndex `json:"indexes,omitempty"`
+	// KeyInt, KeyString or KeyBytes, for the records
+	KeyType string          `json:"key_type,omitempty"`
+	Key     json.RawMessage `json:"key,omitempty"`
+	// Decoded value of the record
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// DumpIndex describes an index of a bucket.
+type DumpIndex struct {
+	Field  string `json:"field"`
+	Unique bool   `json:"unique"`
+}
+
+// Dump writes the content of the source database to w in JSON lines, whatever the version of Storm that created it.
+// The first line is a DumpHeader entry, followed for every bucket by a DumpBucket entry and a DumpRecord entry per record.
+// The registered types and keys are used to decode the records, the other buckets created by Storm, including the ones
+// nested under the paths given to AddBucketsAt or AddKVAt, are decoded generically and the type of their keys is guessed.
+// Dump fails with an UnregisteredBucketsError if buckets were not created by Storm, unless OnUnregistered(Skip)
+// is given to leave them out, and with an Error if the records of a bucket can't be decoded without their type,
+// which is the case of the gob and protobuf codecs: the types must then be registered, with AddKVValues for the values
+// of the buckets created with Set. Nothing is written in these cases.
+// The source database is opened in read-only mode.
+func (m *Migrator) Dump(w io.Writer, options ...func(*Migrator) error) error {
+	for _, option := range options {
+		err := option(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := openSource(m.path)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	version, err := m.getVersion(b)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := m.expandNodes(b)
+	if err != nil {
+		return err
+	}
+
+	return b.View(func(tx *bolt.Tx) error {
+		buckets, err := m.dumpedBuckets(tx, nodes)
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(w)
+		err = enc.Encode(DumpEntry{Entry: DumpHeader, Version: version, Codec: m.forceCodec.Name()})
+		if err != nil {
+			return err
+		}
+
+		d := dumper{m: m, enc: enc, version: version}
+		for _, db := range buckets {
+			if db.kind == TypeBucket {
+				err = d.typeBucket(db.path, db.bucket, db.typ)
+			} else {
+				err = d.kvBucket(db.path, db.bucket, db.registered, db.instances)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+var errDumpKVValues = errors.New("the values can't be decoded without their type, they must be registered with AddKVValues")
+
+// dumpedBucket is a bucket written by Dump.
+type dumpedBucket struct {
+	path   []string
+	bucket *bolt.Bucket
+	// TypeBucket or KVBucket
+	kind string
+	// type registered for a bucket created with Save, if any
+	typ reflect.Type
+	// name registered with AddKV or AddKVFunc, or key instances given to AddKVAt, for a bucket created with Set
+	registered string
+	instances  []interface{}
+}
+
+// dumpedBuckets returns the buckets to dump, registered or not. It fails before anything is written
+// if a bucket can't be dumped: the foreign buckets, unless the Skip policy is used, and the buckets
+// whose records can't be decoded without their type.
+func (m *Migrator) dumpedBuckets(tx *bolt.Tx, nodes []Node) ([]dumpedBucket, error) {
+	types := make(map[string]reflect.Type)
+	for _, inst := range m.instances {
+		types[m.sourceName(bucketName(inst))] = reflect.Indirect(reflect.ValueOf(inst)).Type()
+	}
+
+	kv := make(map[string]string)
+	for _, name := range m.kvBuckets() {
+		kv[m.sourceName(name)] = name
+	}
+
+	var list []dumpedBucket
+	foreign := make(map[string]string)
+
+	// unregistered adds a bucket that wasn't registered, depending on its content
+	unregistered := func(path []string, bucket *bolt.Bucket) {
+		kind := classifyBucket(bucket, m.codecAt(path[:len(path)-1], path[len(path)-1]))
+		if kind == ForeignBucket {
+			foreign[strings.Join(path, "/")] = kind
+			return
+		}
+		list = append(list, dumpedBucket{path: path, bucket: bucket, kind: kind})
+	}
+
+	// walk adds the buckets nested under a node root: the ones that were not registered are dumped like
+	// the unregistered top level buckets
+	var walk func(path []string, parent *bolt.Bucket)
+	walk = func(path []string, parent *bolt.Bucket) {
+		var node *Node
+		var prefixes []string
+		for i := range nodes {
+			switch {
+			case len(nodes[i].Path) == len(path) && hasPrefix(nodes[i].Path, path):
+				node = &nodes[i]
+			case len(nodes[i].Path) > len(path) && hasPrefix(nodes[i].Path, path):
+				prefixes = append(prefixes, nodes[i].Path[len(path)])
+			}
+		}
+
+		nodeTypes := make(map[string]reflect.Type)
+		var nodeKV map[string][]interface{}
+		if node != nil {
+			for _, inst := range node.Instances {
+				nodeTypes[bucketName(inst)] = reflect.Indirect(reflect.ValueOf(inst)).Type()
+			}
+			nodeKV = node.KV
+		}
+
+		_ = parent.ForEach(func(k, v []byte) error {
+			if v != nil || bytes.HasPrefix(k, []byte("__storm")) {
+				return nil
+			}
+
+			name := string(k)
+			child := append(path[:len(path):len(path)], name)
+			bucket := parent.Bucket(k)
+			switch {
+			case nodeTypes[name] != nil:
+				list = append(list, dumpedBucket{path: child, bucket: bucket, kind: TypeBucket, typ: nodeTypes[name]})
+			case nodeKV[name] != nil:
+				list = append(list, dumpedBucket{path: child, bucket: bucket, kind: KVBucket, instances: nodeKV[name]})
+			case contains(prefixes, name):
+				walk(child, bucket)
+			default:
+				unregistered(child, bucket)
+			}
+			return nil
+		})
+	}
+
+	roots := make(map[string]bool)
+	for _, n := range nodes {
+		roots[n.Path[0]] = true
+	}
+
+	_ = tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		n := string(name)
+		switch {
+		case n == dbinfoBucket || n == metadataBucket || n == historyBucket:
+		case types[n] != nil:
+			list = append(list, dumpedBucket{path: []string{n}, bucket: bucket, kind: TypeBucket, typ: types[n]})
+		case kv[n] != "":
+			list = append(list, dumpedBucket{path: []string{n}, bucket: bucket, kind: KVBucket, registered: kv[n]})
+		case roots[n]:
+			walk([]string{n}, bucket)
+		default:
+			unregistered([]string{n}, bucket)
+		}
+		return nil
+	})
+
+	if len(foreign) > 0 && m.onUnregistered != Skip {
+		return nil, &UnregisteredBucketsError{Buckets: foreign}
+	}
+
+	for _, db := range list {
+		c := m.codecAt(db.path[:len(db.path)-1], db.path[len(db.path)-1])
+		if genericCodec(c) {
+			continue
+		}
+
+		switch {
+		case db.kind == TypeBucket && db.typ == nil:
+			return nil, &Error{Bucket: strings.Join(db.path, "/"), Err: fmt.Errorf("%w by the %s codec", errRawCodec, c.Name())}
+		case db.kind == KVBucket && len(m.kvValues[db.registered]) == 0:
+			return nil, &Error{Bucket: strings.Join(db.path, "/"), Err: errDumpKVValues}
+		}
+	}
+
+	return list, nil
+}
+
+// hasPrefix reports whether path starts with the elements of prefix.
+func hasPrefix(path, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// dumper writes the buckets of a database.
+type dumper struct {
+	m       *Migrator
+	enc     *json.Encoder
+	version string
+}
+
+// typeBucket dumps a bucket created with Save, decoding the records with the given type if any.
+func (d *dumper) typeBucket(path []string, bucket *bolt.Bucket, typ reflect.Type) error {
+	name := path[len(path)-1]
+	c := d.m.codecAt(path[:len(path)-1], name)
+
+	entry := DumpEntry{Entry: DumpBucket, Path: path, Kind: TypeBucket, Codec: c.Name()}
+	if typ != nil {
+		entry.Indexes = typeIndexes(typ)
+	} else {
+		entry.Indexes = bucketIndexes(bucket)
+	}
+
+	err := d.enc.Encode(entry)
+	if err != nil {
+		return err
+	}
+
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		record := DumpEntry{Entry: DumpRecord, Path: path}
+
+		var value interface{}
+		if typ != nil {
+			ref := reflect.New(typ)
+			err := c.Unmarshal(v, ref.Interface())
+			if err != nil {
+				return &Error{Bucket: strings.Join(path, "/"), Key: append([]byte(nil), k...), Type: typ, Err: err}
+			}
+
+			var key interface{}
+			if id, _ := inspectRecord(ref); id.IsValid() {
+				key = id.Interface()
+			}
+			record.KeyType, record.Key, err = typedKey(key, k)
+			if err != nil {
+				return err
+			}
+			value = ref.Interface()
+		} else {
+			var fields map[string]interface{}
+			err := c.Unmarshal(v, &fields)
+			if err != nil {
+				return &Error{Bucket: strings.Join(path, "/"), Key: append([]byte(nil), k...), Err: err}
+			}
+
+			record.KeyType, record.Key, err = typedKey(d.genericKey(k, c, fields), k)
+			if err != nil {
+				return err
+			}
+			value = fields
+		}
+
+		var err error
+		record.Value, err = json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		return d.enc.Encode(record)
+	})
+}
+
+// kvBucket dumps a bucket created with Set. The keys are decoded using the bucket registered with AddKV
+// or AddKVFunc, or the given instances.
+func (d *dumper) kvBucket(path []string, bucket *bolt.Bucket, registered string, instances []interface{}) error {
+	name := path[len(path)-1]
+	c := d.m.codecAt(path[:len(path)-1], name)
+
+	err := d.enc.Encode(DumpEntry{Entry: DumpBucket, Path: path, Kind: KVBucket, Codec: c.Name()})
+	if err != nil {
+		return err
+	}
+
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		var key interface{}
+		var ok bool
+		switch {
+		case registered != "":
+			key, ok = d.m.decodeKVKey(d.version, registered, k)
+		case len(instances) > 0:
+			key, ok = decodeKey(d.version, k, instances, c)
+		}
+		if !ok {
+			key = d.genericKey(k, c, nil)
+		}
+
+		value, err := d.m.decodeKVValue(registered, v, c)
+		if err != nil {
+			return &Error{Bucket: strings.Join(path, "/"), Key: append([]byte(nil), k...), Err: err}
+		}
+
+		record := DumpEntry{Entry: DumpRecord, Path: path}
+		record.KeyType, record.Key, err = typedKey(key, k)
+		if err != nil {
+			return err
+		}
+
+		record.Value, err = json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		return d.enc.Encode(record)
+	})
+}
+
+// genericKey guesses the type of a key whose type wasn't registered. The fields of the record,
+// if any, tell whether a key of 8 bytes is a binary integer or a string.
+func (d *dumper) genericKey(k []byte, c codec.MarshalUnmarshaler, fields map[string]interface{}) interface{} {
+	if !binaryKeys(d.version) {
+		var key interface{}
+		if c.Unmarshal(k, &key) == nil {
+			if f, ok := key.(float64); ok && f == math.Trunc(f) {
+				return int64(f)
+			}
+			if s, ok := key.(string); ok {
+				return s
+			}
+		}
+		return k
+	}
+
+	for _, v := range fields {
+		if s, ok := v.(string); ok && s == string(k) {
+			return s
+		}
+	}
+
+	if n, ok := decodeNumber(k, reflect.TypeOf(int64(0))); ok && (fields != nil || !printable(k)) {
+		return n.Int()
+	}
+
+	if printable(k) {
+		return string(k)
+	}
+	return k
+}
+
+func printable(k []byte) bool {
+	for _, c := range k {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// typedKey returns the type and the JSON encoding of a decoded key. Keys of other types are dumped as raw bytes.
+func typedKey(key interface{}, raw []byte) (string, json.RawMessage, error) {
+	v := reflect.ValueOf(key)
+	var keyType string
+	switch {
+	case v.IsValid() && isIntegerKind(v.Kind()):
+		keyType = KeyInt
+	case v.IsValid() && v.Kind() == reflect.String:
+		keyType = KeyString
+	default:
+		keyType = KeyBytes
+		if b, ok := key.([]byte); ok {
+			raw = b
+		}
+		key = raw
+	}
+
+	encoded, err := json.Marshal(key)
+	return keyType, encoded, err
+}
+
+// typeIndexes returns the indexes declared by the tags of a type.
+func typeIndexes(t reflect.Type) []DumpIndex {
+	var list []DumpIndex
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		for _, tag := range strings.Split(f.Tag.Get("storm"), ",") {
+			switch tag {
+			case "index":
+				list = append(list, DumpIndex{Field: f.Name})
+			case "unique":
+				list = append(list, DumpIndex{Field: f.Name, Unique: true})
+			case "inline":
+				if ft := f.Type; ft.Kind() == reflect.Struct {
+					list = append(list, typeIndexes(ft)...)
+				} else if ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct {
+					list = append(list, typeIndexes(ft.Elem())...)
+				}
+			}
+		}
+	}
+
+	return list
+}
+
+// bucketIndexes returns the indexes found in a bucket. List indexes have an ids bucket in every version.
+func bucketIndexes(bucket *bolt.Bucket) []DumpIndex {
+	var list []DumpIndex
+	c := bucket.Cursor()
+	for k, v := c.Seek([]byte(indexPrefix)); strings.HasPrefix(string(k), indexPrefix); k, v = c.Next() {
+		if v == nil {
+			list = append(list, DumpIndex{
+				Field:  string(k[len(indexPrefix):]),
+				Unique: bucket.Bucket(k).Bucket([]byte(listIDs)) == nil,
+			})
+		}
+	}
+
+	return list
+}
+
+// Load reads a dump written by Dump and saves its content in a new Storm v0.6 database at the given path,
+// using Save for the records of the buckets created with Save, so that they are indexed, and Set for the others.
+// The types of the buckets created with Save must be registered, with AddBuckets or AddBucketsAt.
+// The database uses the codec of the dump, or the one set with ConvertCodec. It is removed if the load fails.
+func (m *Migrator) Load(r io.Reader, dst string, options ...func(*Migrator) error) error {
+	for _, option := range options {
+		err := option(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := os.Stat(dst)
+	if err == nil {
+		return fmt.Errorf("%w: %s", ErrDestinationExists, dst)
+	}
+
+	err = m.load(r, dst)
+	if err != nil {
+		// don't leave a partial database
+		os.Remove(dst)
+	}
+	return err
+}
+
+func (m *Migrator) load(r io.Reader, dst string) error {
+	dec := json.NewDecoder(r)
+	var header DumpEntry
+	err := dec.Decode(&header)
+	if err != nil {
+		return err
+	}
+	if header.Entry != DumpHeader {
+		return errors.New("the dump doesn't start with a header")
+	}
+
+	c := m.convertTo
+	if c == nil {
+		c = builtinCodec(header.Codec)
+	}
+	if c == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownCodec, header.Codec)
+	}
+
+	db, err := stormv06.Open(dst, stormv06.Codec(c))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	batchSize := m.batchSize
+	if batchSize == 0 {
+		batchSize = 1000
+	}
+
+	l := loader{m: m, db: db}
+	for {
+		var e DumpEntry
+		err = dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch e.Entry {
+		case DumpBucket:
+			err = l.flush()
+			if err != nil {
+				return err
+			}
+
+			l.bucket = e
+			l.typ = nil
+			if e.Kind == TypeBucket {
+				l.typ = m.bucketType(strings.Join(e.Path, "/"))
+				if l.typ == nil {
+					return fmt.Errorf("no type registered for bucket %s", strings.Join(e.Path, "/"))
+				}
+			}
+		case DumpRecord:
+			l.records = append(l.records, e)
+			if len(l.records) >= batchSize {
+				err = l.flush()
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected dump entry %q", e.Entry)
+		}
+	}
+
+	return l.flush()
+}
+
+// loader saves the records of a dump, bucket by bucket.
+type loader struct {
+	m  *Migrator
+	db *stormv06.DB
+	// bucket being loaded
+	bucket  DumpEntry
+	typ     reflect.Type
+	records []DumpEntry
+}
+
+// flush saves the pending records in a single transaction.
+func (l *loader) flush() error {
+	if len(l.records) == 0 {
+		return nil
+	}
+
+	path := l.bucket.Path
+	name := path[len(path)-1]
+	records := l.records
+	l.records = nil
+
+	return l.db.Bolt.Update(func(tx *bolt.Tx) error {
+		n := l.db.WithTransaction(tx).From(path[:len(path)-1]...)
+		for _, e := range records {
+			var err error
+			if l.typ != nil {
+				record := reflect.New(l.typ)
+				err = json.Unmarshal(e.Value, record.Interface())
+				if err == nil {
+					err = n.Save(record.Interface())
+				}
+			} else {
+				var key, value interface{}
+				key, err = loadKey(e)
+				if err == nil {
+					value, err = l.m.loadValue(name, e.Value)
+				}
+				if err == nil {
+					err = n.Set(name, key, value)
+				}
+			}
+			if err != nil {
+				return &Error{Bucket: strings.Join(path, "/"), Key: e.Key, Type: l.typ, Err: err}
+			}
+		}
+		return nil
+	})
+}
+
+// loadKey decodes the key of a record of a bucket created with Set.
+func loadKey(e DumpEntry) (interface{}, error) {
+	var err error
+	switch e.KeyType {
+	case KeyInt:
+		var key int64
+		err = json.Unmarshal(e.Key, &key)
+		return key, err
+	case KeyString:
+		var key string
+		err = json.Unmarshal(e.Key, &key)
+		return key, err
+	case KeyBytes:
+		var key []byte
+		err = json.Unmarshal(e.Key, &key)
+		return key, err
+	}
+
+	return nil, fmt.Errorf("unknown key type %q", e.KeyType)
+}
+
+// loadValue decodes a value of a bucket created with Set using the instances registered with AddKVValues, if any.
+// Otherwise, integral numbers are decoded as int64.
+func (m *Migrator) loadValue(bucketName string, raw json.RawMessage) (interface{}, error) {
+	var err error
+	for _, inst := range m.kvValues[bucketName] {
+		value := reflect.New(reflect.Indirect(reflect.ValueOf(inst)).Type())
+		err = json.Unmarshal(raw, value.Interface())
+		if err == nil {
+			return value.Elem().Interface(), nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	err = json.Unmarshal(raw, &value)
+	if f, ok := value.(float64); ok && f == math.Trunc(f) {
+		return int64(f), err
+	}
+	return value, err
+}
@@ -0,0 +1,247 @@
+package migrator_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	gobv04 "github.com/asdine/storm-migrator/v0.4/codec/gob"
+	"github.com/asdine/storm-migrator/v0.5/codec/gob"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+func readDump(t *testing.T, buf *bytes.Buffer) []migrator.DumpEntry {
+	var entries []migrator.DumpEntry
+	s := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for s.Scan() {
+		var e migrator.DumpEntry
+		require.NoError(t, json.Unmarshal(s.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	require.NoError(t, s.Err())
+	return entries
+}
+
+func TestDump(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		err = dbv04.Save(&Untyped{ID: i + 1, Name: fmt.Sprintf("name%d", i), Email: fmt.Sprintf("%d@example.com", i)})
+		require.NoError(t, err)
+	}
+	dbv04.Close()
+
+	var buf bytes.Buffer
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Dump(&buf)
+	require.NoError(t, err)
+
+	entries := readDump(t, &buf)
+	require.Equal(t, migrator.DumpHeader, entries[0].Entry)
+	require.Equal(t, "0.4.1", entries[0].Version)
+	require.Equal(t, "json", entries[0].Codec)
+
+	buckets := make(map[string]migrator.DumpEntry)
+	records := make(map[string][]migrator.DumpEntry)
+	for _, e := range entries[1:] {
+		switch e.Entry {
+		case migrator.DumpBucket:
+			buckets[e.Path[0]] = e
+		case migrator.DumpRecord:
+			records[e.Path[0]] = append(records[e.Path[0]], e)
+		}
+	}
+
+	require.Equal(t, migrator.TypeBucket, buckets["A"].Kind)
+	require.Len(t, records["A"], 10)
+	require.Equal(t, migrator.KeyInt, records["A"][0].KeyType)
+	require.Equal(t, migrator.KeyString, records["B"][0].KeyType)
+	require.Equal(t, migrator.KVBucket, buckets["bucket"].Kind)
+	require.Len(t, records["bucket"], 20)
+
+	// the unregistered bucket is decoded generically
+	require.Equal(t, migrator.TypeBucket, buckets["Untyped"].Kind)
+	require.ElementsMatch(t, []migrator.DumpIndex{{Field: "Name"}, {Field: "Email", Unique: true}, {Field: "Age"}}, buckets["Untyped"].Indexes)
+	require.Len(t, records["Untyped"], 3)
+	require.Equal(t, migrator.KeyInt, records["Untyped"][0].KeyType)
+	require.JSONEq(t, "1", string(records["Untyped"][0].Key))
+
+	// the dump can be loaded once the types are registered
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	err = m.Load(bytes.NewReader(buf.Bytes()), filepath.Join(dir, "loaded.db"))
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "loaded.db"))
+	require.True(t, os.IsNotExist(err))
+
+	m.AddBuckets(new(Untyped))
+	err = m.Load(bytes.NewReader(buf.Bytes()), filepath.Join(dir, "other.db"))
+	require.NoError(t, err)
+
+	db, err := stormv06.Open(filepath.Join(dir, "other.db"))
+	require.NoError(t, err)
+
+	var version string
+	err = db.Get("__storm_db", "version", &version)
+	require.NoError(t, err)
+	require.Equal(t, "0.6.0", version)
+
+	var a A
+	err = db.One("ID", 4, &a)
+	require.NoError(t, err)
+	require.Equal(t, "Field3", a.Field1)
+
+	var u Untyped
+	err = db.One("Email", "2@example.com", &u)
+	require.NoError(t, err)
+	require.Equal(t, 3, u.ID)
+
+	var v int
+	err = db.Get("bucket", 14, &v)
+	require.NoError(t, err)
+	require.Equal(t, 3, v)
+
+	var s A
+	err = db.Get("bucket", "string1", &s)
+	require.NoError(t, err)
+	require.Equal(t, 11, s.ID)
+	db.Close()
+
+	// the same records are dumped from the migrated database
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.OnUnregistered(migrator.CopyVerbatim))
+	require.NoError(t, err)
+
+	var migrated bytes.Buffer
+	m = migrator.New(filepath.Join(dir, "v06.db"))
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Dump(&migrated)
+	require.NoError(t, err)
+
+	after := readDump(t, &migrated)
+	require.Equal(t, "0.6.0", after[0].Version)
+
+	// the unregistered bucket is copied as is
+	registered := func(entries []migrator.DumpEntry) []migrator.DumpEntry {
+		var list []migrator.DumpEntry
+		for _, e := range entries[1:] {
+			if e.Path[0] != "Untyped" {
+				list = append(list, e)
+			}
+		}
+		return list
+	}
+	// the keys are not sorted the same way
+	require.ElementsMatch(t, registered(entries), registered(after))
+}
+
+func TestDumpUnregistered(t *testing.T) {
+	_, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	err = dbv04.From("users").Save(&A{ID: 1, Field1: "a"})
+	require.NoError(t, err)
+	err = dbv04.From("users").Save(&Untyped{ID: 1, Name: "name", Email: "1@example.com"})
+	require.NoError(t, err)
+	err = dbv04.Bolt.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("junk"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte{0, 1, 2})
+	})
+	require.NoError(t, err)
+	dbv04.Close()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddBucketsAt([]string{"users"}, new(A))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+
+	// the foreign buckets are not left out silently
+	var buf bytes.Buffer
+	err = m.Dump(&buf)
+	var uerr *migrator.UnregisteredBucketsError
+	require.True(t, errors.As(err, &uerr))
+	require.Equal(t, map[string]string{"junk": migrator.ForeignBucket}, uerr.Buckets)
+	require.Zero(t, buf.Len())
+
+	err = m.Dump(&buf, migrator.OnUnregistered(migrator.Skip))
+	require.NoError(t, err)
+
+	buckets := make(map[string]migrator.DumpEntry)
+	records := make(map[string]int)
+	for _, e := range readDump(t, &buf)[1:] {
+		switch e.Entry {
+		case migrator.DumpBucket:
+			buckets[fmt.Sprint(e.Path)] = e
+		case migrator.DumpRecord:
+			records[fmt.Sprint(e.Path)]++
+		}
+	}
+	require.NotContains(t, buckets, "[junk]")
+	require.Equal(t, 1, records["[users A]"])
+
+	// the unregistered bucket nested under the node is decoded generically
+	require.Equal(t, migrator.TypeBucket, buckets["[users Untyped]"].Kind)
+	require.Equal(t, 1, records["[users Untyped]"])
+}
+
+func TestDumpGob(t *testing.T) {
+	dir, _, cleanup := prepareDB(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "gob.db")
+	dbv04, err := stormv04.Open(path, stormv04.Codec(gobv04.Codec))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		err = dbv04.Set("settings", i, fmt.Sprintf("value%d", i))
+		require.NoError(t, err)
+	}
+	dbv04.Close()
+
+	// gob can't decode the values without their type
+	m := migrator.New(path)
+	var buf bytes.Buffer
+	err = m.Dump(&buf, migrator.Codec(gob.Codec))
+	var uerr *migrator.UnregisteredBucketsError
+	require.True(t, errors.As(err, &uerr))
+	require.Equal(t, map[string]string{"settings": migrator.ForeignBucket}, uerr.Buckets)
+
+	m = migrator.New(path)
+	m.AddKV("settings", []interface{}{new(int)})
+	err = m.Dump(&buf, migrator.Codec(gob.Codec))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "AddKVValues")
+	var merr *migrator.Error
+	require.True(t, errors.As(err, &merr))
+	require.Equal(t, "settings", merr.Bucket)
+	require.Zero(t, buf.Len())
+
+	m.AddKVValues("settings", []interface{}{new(string)})
+	err = m.Dump(&buf, migrator.Codec(gob.Codec))
+	require.NoError(t, err)
+
+	entries := readDump(t, &buf)
+	require.Len(t, entries, 5)
+	require.JSONEq(t, `"value2"`, string(entries[4].Value))
+}
@@ -0,0 +1,189 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	stormv05 "github.com/asdine/storm-migrator/v0.5"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+)
+
+// Errors
+var (
+	// ErrUnknownVersion is returned when no registered step handles a version.
+	ErrUnknownVersion = errors.New("unknown version")
+
+	// ErrUnsupportedVersion is returned when a version is older than every registered step.
+	// Errors matching it also match ErrUnknownVersion.
+	ErrUnsupportedVersion = errors.New("unsupported version")
+
+	// ErrNewerThanSupported is returned when a version is newer than every registered step.
+	// Errors matching it also match ErrUnknownVersion.
+	ErrNewerThanSupported = errors.New("version newer than the supported ones")
+
+	// ErrNoPath is returned when a version can't be reached using the registered steps.
+	ErrNoPath = errors.New("no migration path between these versions")
+
+	// ErrNewerThanTarget is returned when the database is already newer than the target version.
+	ErrNewerThanTarget = errors.New("the database is newer than the target version")
+
+	// ErrCycle is returned when registering a step would create a cycle between versions.
+	ErrCycle = errors.New("steps must not form a cycle")
+
+	// ErrDuplicateStep is returned when a step between the same versions is already registered.
+	ErrDuplicateStep = errors.New("a step between these versions is already registered")
+
+	// ErrUnknownCodec is returned when none of the built-in codecs can decode the records of a bucket.
+	ErrUnknownCodec = errors.New("no codec can decode the records")
+
+	// ErrDestinationExists is returned when the path the database must be migrated to already exists.
+	ErrDestinationExists = errors.New("destination already exists")
+
+	// ErrSourceLocked is returned when the source database is opened by another process.
+	ErrSourceLocked = errors.New("source database is locked")
+)
+
+// versionError is returned when no registered step handles a version.
+type versionError struct {
+	err     error
+	version string
+}
+
+func (e *versionError) Error() string {
+	return fmt.Sprintf("%v: %s", e.err, e.version)
+}
+
+// Is makes the more specific errors match ErrUnknownVersion as well.
+func (e *versionError) Is(target error) bool {
+	return target == e.err || target == ErrUnknownVersion
+}
+
+// Error is returned when the migration of a bucket or a record fails.
+// It wraps the cause, which can be retrieved using errors.Is or errors.As.
+type Error struct {
+	// Versions of the step that failed, empty if the error happened outside of the steps
+	From, To string
+	// Path of the bucket, the elements being separated by slashes
+	Bucket string
+	// Raw key of the record, if any
+	Key []byte
+	// Type registered for the bucket, if any
+	Type reflect.Type
+	Err  error
+}
+
+func (e *Error) Error() string {
+	var parts []string
+	if e.From != "" || e.To != "" {
+		parts = append(parts, fmt.Sprintf("step %s -> %s", e.From, e.To))
+	}
+	if e.Bucket != "" {
+		parts = append(parts, "bucket "+e.Bucket)
+	}
+	if e.Key != nil {
+		parts = append(parts, fmt.Sprintf("key %q", e.Key))
+	}
+	if e.Type != nil {
+		parts = append(parts, "type "+e.Type.String())
+	}
+
+	if len(parts) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", strings.Join(parts, ", "), e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// migrationError turns an error returned by a step, or by the passes done after the steps if from and to
+// are empty, into an Error with the bucket, the key and the type it happened with.
+func (m *Migrator) migrationError(from, to string, err error) error {
+	e := Error{From: from, To: to, Err: err}
+
+	var (
+		merr   *Error
+		merr05 *stormv05.MigrationError
+		merr06 *stormv06.MigrationError
+	)
+	switch {
+	case errors.As(err, &merr):
+		if merr.From == "" && merr.To == "" {
+			merr.From, merr.To = from, to
+		}
+		return err
+	case errors.As(err, &merr05):
+		e.Bucket, e.Key, e.Err = merr05.Bucket, merr05.Key, merr05.Err
+	case errors.As(err, &merr06):
+		e.Bucket, e.Key, e.Err = merr06.Bucket, merr06.Key, merr06.Err
+	case from == "" && to == "":
+		// nothing to add
+		return err
+	}
+
+	e.Type = m.bucketType(e.Bucket)
+	return &e
+}
+
+// bucketType returns the type registered for the bucket at the given path, or nil.
+func (m *Migrator) bucketType(path string) reflect.Type {
+	if path == "" {
+		return nil
+	}
+
+	instances := m.instances
+	elems := strings.Split(path, "/")
+	if len(elems) > 1 {
+		instances = nil
+		for _, n := range m.nodes {
+			instances = append(instances, n.Instances...)
+		}
+	}
+
+	for _, inst := range instances {
+		if bucketName(inst) == elems[len(elems)-1] {
+			return reflect.Indirect(reflect.ValueOf(inst)).Type()
+		}
+	}
+
+	return nil
+}
+
+// UnmatchedKeysError is returned by Run when some keys of the buckets registered with AddKV or AddKVFunc
+// couldn't be decoded. The rest of the migration is done, these keys are left in their old encoding.
+type UnmatchedKeysError struct {
+	// Raw keys, by bucket name
+	Keys map[string][][]byte
+}
+
+func (e *UnmatchedKeysError) Error() string {
+	names := make([]string, 0, len(e.Keys))
+	for name := range e.Keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list []string
+	for _, name := range names {
+		for _, k := range e.Keys[name] {
+			list = append(list, fmt.Sprintf("%s: %q", name, k))
+		}
+	}
+
+	return fmt.Sprintf("%d keys couldn't be decoded: %s", len(list), strings.Join(list, ", "))
+}
+
+// AmbiguousCodecError is returned when detecting the codecs if several codecs can decode the records of a bucket.
+type AmbiguousCodecError struct {
+	Bucket string
+	// Names of the codecs that can decode the records
+	Codecs []string
+}
+
+func (e *AmbiguousCodecError) Error() string {
+	return fmt.Sprintf("the records of bucket %s can be decoded by several codecs: %s", e.Bucket, strings.Join(e.Codecs, ", "))
+}
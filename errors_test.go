@@ -0,0 +1,47 @@
+package migrator_test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	migrator "github.com/asdine/storm-migrator"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrors(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	// the destination exists
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	err := m.Run(path)
+	require.True(t, errors.Is(err, migrator.ErrDestinationExists))
+
+	// the source is opened by another process
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	require.NoError(t, err)
+	err = m.Run(filepath.Join(dir, "locked.db"))
+	require.True(t, errors.Is(err, migrator.ErrSourceLocked))
+
+	// a record can't be decoded
+	err = b.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("A")).Put([]byte("3"), []byte("not json"))
+	})
+	require.NoError(t, err)
+	b.Close()
+
+	err = m.Run(filepath.Join(dir, "v06.db"))
+	var merr *migrator.Error
+	require.True(t, errors.As(err, &merr))
+	require.Equal(t, "0.4", merr.From)
+	require.Equal(t, "0.5", merr.To)
+	require.Equal(t, "A", merr.Bucket)
+	require.Equal(t, []byte("3"), merr.Key)
+	require.Equal(t, reflect.TypeOf(A{}), merr.Type)
+	require.Contains(t, err.Error(), `step 0.4 -> 0.5, bucket A, key "3", type migrator_test.A: `)
+}
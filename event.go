@@ -0,0 +1,155 @@
+package migrator
+
+import (
+	"fmt"
+	"time"
+)
+
+// Number of records processed between two RecordsProcessed events
+const defaultProgressInterval = 1000
+
+// EventType is the type of an Event.
+type EventType int
+
+// Types of events emitted during a migration.
+const (
+	StepStarted EventType = iota + 1
+	StepFinished
+	BucketStarted
+	BucketFinished
+	RecordsProcessed
+	KeySkipped
+	CodecDetected
+	BucketUnregistered
+)
+
+var eventTypes = map[EventType]string{
+	StepStarted:        "step_started",
+	StepFinished:       "step_finished",
+	BucketStarted:      "bucket_started",
+	BucketFinished:     "bucket_finished",
+	RecordsProcessed:   "records_processed",
+	KeySkipped:         "key_skipped",
+	CodecDetected:      "codec_detected",
+	BucketUnregistered: "bucket_unregistered",
+}
+
+func (t EventType) String() string {
+	if s, ok := eventTypes[t]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// MarshalText encodes the type using its name.
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Event describes the progress of a migration.
+type Event struct {
+	Type EventType `json:"type"`
+	// Versions of the current step
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Bucket being migrated, empty for step events
+	Bucket string `json:"bucket,omitempty"`
+	// Number of records processed so far in the bucket
+	Records int `json:"records,omitempty"`
+	// Raw key that couldn't be decoded, for KeySkipped events
+	Key []byte `json:"key,omitempty"`
+	// Name of the codec of the bucket, for CodecDetected events
+	Codec string `json:"codec,omitempty"`
+	// Kind of the bucket, for BucketUnregistered events
+	Kind string `json:"kind,omitempty"`
+	// Time elapsed since the migration started
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// OnEvent option registers a function called for every event emitted during the migration.
+// Events are emitted from the goroutine calling Run.
+func OnEvent(fn func(Event)) func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.onEvent = fn
+		return nil
+	}
+}
+
+// ProgressInterval option sets the number of records processed between two RecordsProcessed events.
+// The default is 1000.
+func ProgressInterval(n int) func(*Migrator) error {
+	return func(m *Migrator) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid progress interval %d", n)
+		}
+		m.progressInterval = n
+		return nil
+	}
+}
+
+// emit sends the event to the registered function, if any.
+// RecordsProcessed events are only sent every progressInterval records.
+// The skipped keys are collected to be reported at the end of the migration,
+// the records migrated by each bucket to be recorded in the history
+// and the last progress to describe where an interrupted migration stopped.
+func (m *Migrator) emit(e Event) {
+	if e.Type == KeySkipped {
+		if m.unmatched == nil {
+			m.unmatched = make(map[string][][]byte)
+		}
+		m.unmatched[e.Bucket] = append(m.unmatched[e.Bucket], e.Key)
+	}
+
+	if e.Type == BucketFinished && m.entry != nil {
+		m.entry.Records[e.Bucket] = e.Records
+	}
+
+	switch e.Type {
+	case StepStarted, BucketStarted, RecordsProcessed, BucketFinished:
+		m.progress = e
+	}
+
+	if m.onEvent == nil {
+		return
+	}
+
+	if e.Type == RecordsProcessed && e.Records%m.progressInterval != 0 {
+		return
+	}
+
+	e.Elapsed = time.Since(m.started)
+	m.onEvent(e)
+}
+
+// stepObserver turns the notifications of the built-in steps into events.
+type stepObserver struct {
+	step Step
+	emit func(Event)
+}
+
+func (o stepObserver) event(t EventType, bucket string) Event {
+	return Event{Type: t, From: o.step.FromVersion(), To: o.step.ToVersion(), Bucket: bucket}
+}
+
+func (o stepObserver) BucketStarted(bucket string) {
+	o.emit(o.event(BucketStarted, bucket))
+}
+
+func (o stepObserver) RecordProcessed(bucket string, count int) {
+	e := o.event(RecordsProcessed, bucket)
+	e.Records = count
+	o.emit(e)
+}
+
+func (o stepObserver) BucketFinished(bucket string, count int) {
+	e := o.event(BucketFinished, bucket)
+	e.Records = count
+	o.emit(e)
+}
+
+func (o stepObserver) KeySkipped(bucket string, key []byte) {
+	e := o.event(KeySkipped, bucket)
+	e.Key = append([]byte(nil), key...)
+	o.emit(e)
+}
@@ -0,0 +1,75 @@
+package migrator_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnEvent(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	err = dbv04.Set("other", []int{1, 2}, "value")
+	require.NoError(t, err)
+	dbv04.Close()
+
+	var events []migrator.Event
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("other", []interface{}{new(int)})
+	err = m.Run(
+		filepath.Join(dir, "v06.db"),
+		migrator.ProgressInterval(4),
+		migrator.OnEvent(func(e migrator.Event) {
+			events = append(events, e)
+		}),
+	)
+	var uerr *migrator.UnmatchedKeysError
+	require.True(t, errors.As(err, &uerr))
+	require.Equal(t, map[string][][]byte{"other": {[]byte("[1,2]")}}, uerr.Keys)
+
+	// the bucket of prepareDB is not registered
+	require.Equal(t, migrator.BucketUnregistered, events[0].Type)
+	require.Equal(t, "bucket", events[0].Bucket)
+	require.Equal(t, migrator.KVBucket, events[0].Kind)
+	events = events[1:]
+
+	var types []migrator.EventType
+	for i, e := range events {
+		types = append(types, e.Type)
+		if i > 0 {
+			require.True(t, e.Elapsed >= events[i-1].Elapsed)
+		}
+	}
+
+	require.Equal(t, []migrator.EventType{
+		migrator.StepStarted,
+		migrator.BucketStarted, migrator.RecordsProcessed, migrator.RecordsProcessed, migrator.BucketFinished,
+		migrator.BucketStarted, migrator.RecordsProcessed, migrator.RecordsProcessed, migrator.BucketFinished,
+		migrator.BucketStarted, migrator.KeySkipped, migrator.BucketFinished,
+		migrator.StepFinished,
+		migrator.StepStarted,
+		migrator.BucketStarted, migrator.RecordsProcessed, migrator.RecordsProcessed, migrator.BucketFinished,
+		migrator.BucketStarted, migrator.RecordsProcessed, migrator.RecordsProcessed, migrator.BucketFinished,
+		migrator.StepFinished,
+	}, types)
+
+	require.Equal(t, "0.4", events[0].From)
+	require.Equal(t, "0.5", events[0].To)
+	require.Equal(t, "A", events[1].Bucket)
+	require.Equal(t, 8, events[3].Records)
+	require.Equal(t, 10, events[4].Records)
+	require.Equal(t, "other", events[10].Bucket)
+	require.Equal(t, []byte("[1,2]"), events[10].Key)
+	require.Equal(t, "0.6", events[13].To)
+
+	err = m.Run(filepath.Join(dir, "other.db"), migrator.ProgressInterval(0))
+	require.Error(t, err)
+}
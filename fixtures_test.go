@@ -0,0 +1,367 @@
+package migrator_test
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	codecv04 "github.com/asdine/storm-migrator/v0.4/codec"
+	gobv04 "github.com/asdine/storm-migrator/v0.4/codec/gob"
+	jsonv04 "github.com/asdine/storm-migrator/v0.4/codec/json"
+	serealv04 "github.com/asdine/storm-migrator/v0.4/codec/sereal"
+	stormv05 "github.com/asdine/storm-migrator/v0.5"
+	"github.com/asdine/storm-migrator/v0.5/codec"
+	"github.com/asdine/storm-migrator/v0.5/codec/gob"
+	"github.com/asdine/storm-migrator/v0.5/codec/json"
+	"github.com/asdine/storm-migrator/v0.5/codec/protobuf"
+	"github.com/asdine/storm-migrator/v0.5/codec/sereal"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/stretchr/testify/require"
+)
+
+// The fixtures in testdata are regenerated with:
+//
+//	go test -run TestFixtures -update
+var update = flag.Bool("update", false, "regenerate the fixtures in testdata")
+
+var (
+	fixtureVersions = []string{"0.4", "0.5", "0.6"}
+	fixtureCodecs   = []string{"gob", "json", "sereal", "protobuf"}
+)
+
+const (
+	fixtureRecords = 10
+	fixtureKVSize  = 2000
+)
+
+var fixtureTenants = []string{"a", "b"}
+
+type Account struct {
+	ID      int
+	Email   string `storm:"unique"`
+	Group   string `storm:"index"`
+	Profile `storm:"inline"`
+}
+
+type Profile struct {
+	Country string `storm:"index"`
+	Age     int
+}
+
+type Negative struct {
+	ID    int64
+	Value string
+}
+
+type Unsigned struct {
+	ID    uint64
+	Value string
+}
+
+type Named struct {
+	ID   string
+	Kind string `storm:"index"`
+}
+
+// Counter records are saved with AutoIncrement
+type Counter struct {
+	ID    int
+	Label string
+}
+
+// fixtureStore is the part of the API shared by every version of Storm.
+type fixtureStore interface {
+	One(fieldName string, value interface{}, to interface{}) error
+	Get(bucketName string, key interface{}, to interface{}) error
+	Save(data interface{}) error
+	Set(bucketName string, key interface{}, value interface{}) error
+	Count(data interface{}) (int, error)
+}
+
+// fixtureDB wraps a database opened with one version of Storm.
+type fixtureDB struct {
+	fixtureStore
+	from  func(path ...string) fixtureStore
+	find  func(fieldName string, value interface{}, to interface{}) error
+	close func() error
+}
+
+// v04Codec adapts a codec to the interface of Storm v0.4. The protobuf codec of v0.4 isn't imported
+// because it registers the same message type as the one of v0.5.
+type v04Codec struct {
+	codec.MarshalUnmarshaler
+}
+
+func (c v04Codec) Encode(v interface{}) ([]byte, error) { return c.Marshal(v) }
+
+func (c v04Codec) Decode(b []byte, v interface{}) error { return c.Unmarshal(b, v) }
+
+func fixtureCodec(name string) codec.MarshalUnmarshaler {
+	return map[string]codec.MarshalUnmarshaler{
+		"gob":      gob.Codec,
+		"json":     json.Codec,
+		"sereal":   sereal.Codec,
+		"protobuf": protobuf.Codec,
+	}[name]
+}
+
+// openFixture opens the database at path with the given version of Storm, with AutoIncrement enabled.
+func openFixture(t *testing.T, version, path, codecName string) *fixtureDB {
+	switch version {
+	case "0.4":
+		c := map[string]codecv04.EncodeDecoder{
+			"gob":      gobv04.Codec,
+			"json":     jsonv04.Codec,
+			"sereal":   serealv04.Codec,
+			"protobuf": v04Codec{protobuf.Codec},
+		}[codecName]
+		db, err := stormv04.Open(path, stormv04.Codec(c), stormv04.AutoIncrement())
+		require.NoError(t, err)
+		return &fixtureDB{
+			fixtureStore: db,
+			from:         func(path ...string) fixtureStore { return db.From(path...) },
+			find:         func(f string, v, to interface{}) error { return db.Find(f, v, to) },
+			close:        db.Close,
+		}
+	case "0.5":
+		db, err := stormv05.Open(path, stormv05.Codec(fixtureCodec(codecName)), stormv05.AutoIncrement())
+		require.NoError(t, err)
+		return &fixtureDB{
+			fixtureStore: db,
+			from:         func(path ...string) fixtureStore { return db.From(path...) },
+			find:         func(f string, v, to interface{}) error { return db.Find(f, v, to) },
+			close:        db.Close,
+		}
+	default:
+		db, err := stormv06.Open(path, stormv06.Codec(fixtureCodec(codecName)), stormv06.AutoIncrement())
+		require.NoError(t, err)
+		return &fixtureDB{
+			fixtureStore: db,
+			from:         func(path ...string) fixtureStore { return db.From(path...) },
+			find:         func(f string, v, to interface{}) error { return db.Find(f, v, to) },
+			close:        db.Close,
+		}
+	}
+}
+
+func fixturePath(version, codecName string) string {
+	return filepath.Join("testdata", fmt.Sprintf("v%s-%s.db", version, codecName))
+}
+
+// generateFixture writes a database with the given version of Storm and codec.
+func generateFixture(t *testing.T, version, codecName string) {
+	path := fixturePath(version, codecName)
+	err := os.Remove(path)
+	if !os.IsNotExist(err) {
+		require.NoError(t, err)
+	}
+
+	db := openFixture(t, version, path, codecName)
+	defer db.close()
+
+	for i := 0; i < fixtureRecords; i++ {
+		err = db.Save(&Account{
+			ID:      i + 1,
+			Email:   fmt.Sprintf("user%d@example.com", i+1),
+			Group:   fmt.Sprintf("group%d", i%3),
+			Profile: Profile{Country: []string{"fr", "us"}[i%2], Age: 20 + i},
+		})
+		require.NoError(t, err)
+
+		id := int64(i/2 + 1)
+		if i%2 == 0 {
+			id = -id
+		}
+		err = db.Save(&Negative{ID: id, Value: fmt.Sprint(id)})
+		require.NoError(t, err)
+
+		err = db.Save(&Unsigned{ID: math.MaxUint64 - uint64(i), Value: fmt.Sprint(i)})
+		require.NoError(t, err)
+
+		err = db.Save(&Named{ID: fmt.Sprintf("name%d", i), Kind: fmt.Sprintf("kind%d", i%2)})
+		require.NoError(t, err)
+
+		err = db.Save(&Counter{Label: fmt.Sprintf("label%d", i)})
+		require.NoError(t, err)
+
+		err = db.Save(&protobuf.SimpleUser{Id: uint64(i + 1), Name: fmt.Sprintf("user%d", i), Age: int32(i)})
+		require.NoError(t, err)
+	}
+
+	for _, tenant := range fixtureTenants {
+		n := db.from("tenants", tenant)
+		for i := 0; i < 3; i++ {
+			err = n.Save(&Account{ID: i + 1, Email: fmt.Sprintf("%s%d@example.com", tenant, i), Group: tenant})
+			require.NoError(t, err)
+		}
+		err = n.Set("settings", "theme", tenant)
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < fixtureKVSize; i++ {
+		err = db.Set("large", i, fmt.Sprintf("value%d", i))
+		require.NoError(t, err)
+	}
+}
+
+// checkFixture verifies the content of a fixture, or of its migrated version, with the given version of Storm.
+// The nested buckets are only expected if nested is true.
+func checkFixture(t *testing.T, version, path, codecName string, nested bool) {
+	db := openFixture(t, version, path, codecName)
+	defer db.close()
+
+	var a Account
+	err := db.One("Email", "user3@example.com", &a)
+	require.NoError(t, err)
+	require.Equal(t, 3, a.ID)
+	require.Equal(t, Profile{Country: "fr", Age: 22}, a.Profile)
+
+	var accounts []Account
+	err = db.find("Group", "group0", &accounts)
+	require.NoError(t, err)
+	require.Len(t, accounts, 4)
+
+	err = db.find("Country", "us", &accounts)
+	require.NoError(t, err)
+	require.Len(t, accounts, fixtureRecords/2)
+
+	count, err := db.Count(new(Account))
+	require.NoError(t, err)
+	require.Equal(t, fixtureRecords, count)
+
+	var neg Negative
+	err = db.One("ID", int64(-3), &neg)
+	require.NoError(t, err)
+	require.Equal(t, "-3", neg.Value)
+
+	var u Unsigned
+	err = db.One("ID", uint64(math.MaxUint64), &u)
+	require.NoError(t, err)
+	require.Equal(t, "0", u.Value)
+
+	var named []Named
+	err = db.find("Kind", "kind1", &named)
+	require.NoError(t, err)
+	require.Len(t, named, fixtureRecords/2)
+	var n Named
+	err = db.One("ID", "name4", &n)
+	require.NoError(t, err)
+	require.Equal(t, "kind0", n.Kind)
+
+	var user protobuf.SimpleUser
+	err = db.One("Id", uint64(5), &user)
+	require.NoError(t, err)
+	require.Equal(t, "user4", user.Name)
+
+	for _, tenant := range fixtureTenants {
+		node := db.from("tenants", tenant)
+		if !nested {
+			err = node.One("Email", tenant+"1@example.com", &a)
+			require.Error(t, err)
+			continue
+		}
+
+		err = node.One("Email", tenant+"1@example.com", &a)
+		require.NoError(t, err)
+		require.Equal(t, 2, a.ID)
+
+		var theme string
+		err = node.Get("settings", "theme", &theme)
+		require.NoError(t, err)
+		require.Equal(t, tenant, theme)
+	}
+
+	var v string
+	err = db.Get("large", fixtureKVSize-1, &v)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("value%d", fixtureKVSize-1), v)
+	err = db.Get("large", 0, &v)
+	require.NoError(t, err)
+	require.Equal(t, "value0", v)
+
+	// the sequence of the bucket is kept
+	c := Counter{Label: "new"}
+	err = db.Save(&c)
+	require.NoError(t, err)
+	require.Equal(t, fixtureRecords+1, c.ID)
+}
+
+// fixtureMigrator returns a Migrator with the buckets of the fixtures registered.
+// The nested buckets are only registered if nested is true, they are skipped otherwise.
+func fixtureMigrator(path string, nested bool) (*migrator.Migrator, func(*migrator.Migrator) error) {
+	m := migrator.New(path)
+	m.AddBuckets(new(Account), new(Negative), new(Unsigned), new(Named), new(Counter), new(protobuf.SimpleUser))
+	m.AddKV("large", []interface{}{new(int)})
+	if !nested {
+		return m, migrator.OnUnregistered(migrator.Skip)
+	}
+
+	m.AddBucketsAt([]string{"tenants", migrator.Wildcard}, new(Account))
+	m.AddKVAt([]string{"tenants", migrator.Wildcard}, "settings", []interface{}{new(string)})
+	return m, migrator.OnUnregistered(migrator.Fail)
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	in, err := os.Open(src)
+	require.NoError(t, err)
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	require.NoError(t, err)
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	require.NoError(t, err)
+}
+
+func TestFixtures(t *testing.T) {
+	if *update {
+		for _, version := range fixtureVersions {
+			for _, codecName := range fixtureCodecs {
+				generateFixture(t, version, codecName)
+			}
+		}
+	}
+
+	for _, from := range fixtureVersions {
+		for _, codecName := range fixtureCodecs {
+			for _, to := range fixtureVersions {
+				from, codecName, to := from, codecName, to
+				t.Run(fmt.Sprintf("%s/%s/%s", codecName, from, to), func(t *testing.T) {
+					dir := t.TempDir()
+					src := filepath.Join(dir, "src.db")
+					copyFile(t, fixturePath(from, codecName), src)
+
+					if from == to {
+						checkFixture(t, from, src, codecName, true)
+						return
+					}
+
+					// the nested buckets can't be downgraded
+					nested := to > from
+					m, policy := fixtureMigrator(src, nested)
+					options := []func(*migrator.Migrator) error{
+						migrator.Codec(fixtureCodec(codecName)),
+						migrator.TargetVersion(to),
+						migrator.Verify(),
+						policy,
+					}
+					if !nested {
+						options = append(options, migrator.Downgrade())
+					}
+
+					dst := filepath.Join(dir, "dst.db")
+					err := m.Run(dst, options...)
+					require.NoError(t, err)
+					checkFixture(t, to, dst, codecName, nested)
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package migrator
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Version of the migrator, recorded in the history of the migrations.
+const Version = "0.1.0"
+
+// Every step executed on a database is recorded in this bucket.
+// The entries are encoded in JSON whatever the codec of the database, so that they can always be read.
+const historyBucket = "__storm_migrations"
+
+// HistoryEntry describes a step executed on a database.
+type HistoryEntry struct {
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Version of the migrator that ran the step
+	MigratorVersion string `json:"migrator_version"`
+	// Name of the codec used to decode and encode the records
+	Codec string `json:"codec"`
+	// Names of the codecs of the buckets that don't use Codec, by bucket name
+	Codecs map[string]string `json:"codecs,omitempty"`
+	// Number of records migrated by the step, by bucket.
+	// If the step was resumed, only the buckets migrated after resuming are counted
+	Records map[string]int `json:"records,omitempty"`
+}
+
+// History returns the steps executed on the database at the given path, oldest first.
+// The database is opened in read-only mode.
+func History(path string) ([]HistoryEntry, error) {
+	db, err := openSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var entries []HistoryEntry
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var e HistoryEntry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, e)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// startHistory prepares the entry of the given step, the records are counted until it is written.
+func (m *Migrator) startHistory(s Step) {
+	m.entry = &HistoryEntry{
+		From:            s.FromVersion(),
+		To:              s.ToVersion(),
+		Started:         time.Now().UTC(),
+		MigratorVersion: Version,
+		Codec:           m.forceCodec.Name(),
+		Records:         make(map[string]int),
+	}
+
+	for name, c := range m.codecs {
+		if m.entry.Codecs == nil {
+			m.entry.Codecs = make(map[string]string)
+		}
+		m.entry.Codecs[name] = c.Name()
+	}
+}
+
+// writeHistory appends the entry of the current step to the history of the database.
+func (m *Migrator) writeHistory(b *bolt.DB) error {
+	e := m.entry
+	m.entry = nil
+	e.Finished = time.Now().UTC()
+
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return b.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(historyBucket))
+		if err != nil {
+			return err
+		}
+
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, raw)
+	})
+}
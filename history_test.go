@@ -0,0 +1,54 @@
+package migrator_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	entries, err := migrator.History(path)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Run(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+
+	entries, err = migrator.History(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "0.4", entries[0].From)
+	require.Equal(t, "0.5", entries[0].To)
+	require.Equal(t, "0.5", entries[1].From)
+	require.Equal(t, "0.6", entries[1].To)
+	for _, e := range entries {
+		require.Equal(t, migrator.Version, e.MigratorVersion)
+		require.Equal(t, "json", e.Codec)
+		require.False(t, e.Started.After(e.Finished))
+		require.Equal(t, 10, e.Records["A"])
+		require.Equal(t, 10, e.Records["B"])
+	}
+	require.Equal(t, 20, entries[0].Records["bucket"])
+
+	// the history is kept by the next migrations
+	m = migrator.New(filepath.Join(dir, "v06.db"))
+	m.AddBuckets(new(A), new(B))
+	err = m.RegisterStep(&testStep{from: "0.6", to: "0.6.0-app.1"})
+	require.NoError(t, err)
+	err = m.Run(filepath.Join(dir, "app.db"))
+	require.NoError(t, err)
+
+	entries, err = migrator.History(filepath.Join(dir, "app.db"))
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, "0.6.0-app.1", entries[2].To)
+	require.Empty(t, entries[2].Records)
+}
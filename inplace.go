@@ -0,0 +1,186 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RunInPlace migrates the database without requiring a destination.
+// The source is first saved to "<path>.bak-<version>", then a copy of it is migrated and verified
+// in the same directory before atomically replacing the source. If anything fails, the source is restored from the backup.
+// The backup is kept once the migration succeeds and removed if it fails.
+func (m *Migrator) RunInPlace(options ...func(*Migrator) error) error {
+	m.started = time.Now()
+	m.ctx = context.Background()
+	m.progress = Event{}
+
+	for _, option := range options {
+		err := option(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the copy is always verified, without changing the next runs
+	verify := m.verifyAfterRun
+	m.verifyAfterRun = true
+	defer func() { m.verifyAfterRun = verify }()
+
+	err := m.checkSourceDB()
+	if err != nil {
+		return err
+	}
+
+	version, steps, err := m.sourcePath()
+	if err != nil || len(steps) == 0 {
+		return err
+	}
+
+	backup := fmt.Sprintf("%s.bak-%s", m.path, version)
+	_, err = os.Stat(backup)
+	if err == nil {
+		return fmt.Errorf("%w: backup %s", ErrDestinationExists, backup)
+	}
+
+	err = snapshotDB(m.path, backup)
+	if err != nil {
+		return err
+	}
+
+	replaced, err := m.migrateInPlace()
+	if err != nil {
+		// the source is only modified once replaced
+		if replaced {
+			if rerr := restore(backup, m.path); rerr != nil {
+				return fmt.Errorf("%v, restoring the backup failed: %v", err, rerr)
+			}
+		}
+		os.Remove(backup)
+		return err
+	}
+
+	return nil
+}
+
+// migrateInPlace migrates a temporary copy of the source and renames it over the source.
+// It reports whether the source was replaced.
+func (m *Migrator) migrateInPlace() (bool, error) {
+	dir, base := filepath.Split(m.path)
+	f, err := ioutil.TempFile(dir, base+".migrating-")
+	if err != nil {
+		return false, err
+	}
+	tmp := f.Name()
+	f.Close()
+
+	// Run refuses existing destinations
+	err = os.Remove(tmp)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	err = m.run(tmp)
+	if err != nil {
+		return false, err
+	}
+
+	err = syncFile(tmp)
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Rename(tmp, m.path)
+	if err != nil {
+		return false, err
+	}
+
+	return true, syncDir(dir)
+}
+
+// restore replaces the file at path with a copy of the backup.
+func restore(backup, path string) error {
+	dir, base := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, base+".restoring-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+
+	err = copyFile(backup, tmp)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// copyFile copies the content of src to dst and flushes it to disk.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir makes sure a rename in the directory is persisted.
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
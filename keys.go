@@ -0,0 +1,108 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+
+	"github.com/asdine/storm-migrator/v0.5/codec"
+)
+
+// binaryKeys reports whether integer keys are stored in binary by the given version.
+// Storm v0.4 encodes them with the codec.
+func binaryKeys(version string) bool {
+	return compareVersions(version, "0.5") >= 0
+}
+
+// decodeKey decodes a raw key using the first of the given instances that matches,
+// following the rules of the given version.
+func decodeKey(version string, k []byte, instances []interface{}, c codec.MarshalUnmarshaler) (interface{}, bool) {
+	for _, inst := range instances {
+		r := reflect.Indirect(reflect.ValueOf(inst))
+		t := r.Type()
+		switch {
+		case t.Kind() == reflect.String:
+			r.SetString(string(k))
+		case t.AssignableTo(reflect.TypeOf([]byte{})):
+			r.SetBytes(k)
+		case binaryKeys(version) && isIntegerKind(t.Kind()):
+			n, ok := decodeNumber(k, t)
+			if !ok {
+				continue
+			}
+			r.Set(n)
+		default:
+			err := c.Unmarshal(k, inst)
+			if err != nil {
+				continue
+			}
+		}
+
+		return r.Interface(), true
+	}
+
+	return nil, false
+}
+
+// encodeKey encodes a key the same way the given version of Storm does.
+func encodeKey(version string, key interface{}, c codec.MarshalUnmarshaler) ([]byte, error) {
+	switch t := key.(type) {
+	case []byte:
+		return t, nil
+	case string:
+		return []byte(t), nil
+	}
+
+	if !binaryKeys(version) {
+		return c.Marshal(key)
+	}
+
+	switch t := key.(type) {
+	case int:
+		return numbertob(int64(t))
+	case uint:
+		return numbertob(uint64(t))
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		return numbertob(t)
+	default:
+		return c.Marshal(key)
+	}
+}
+
+func numbertob(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeNumber decodes a big endian integer of the given type.
+// int and uint are stored using 8 bytes.
+func decodeNumber(k []byte, t reflect.Type) (reflect.Value, bool) {
+	var n reflect.Value
+	switch t.Kind() {
+	case reflect.Int:
+		n = reflect.New(reflect.TypeOf(int64(0)))
+	case reflect.Uint:
+		n = reflect.New(reflect.TypeOf(uint64(0)))
+	default:
+		n = reflect.New(t)
+	}
+
+	if uintptr(len(k)) != n.Elem().Type().Size() {
+		return n, false
+	}
+
+	err := binary.Read(bytes.NewReader(k), binary.BigEndian, n.Interface())
+	if err != nil {
+		return n, false
+	}
+
+	return n.Elem().Convert(t), true
+}
+
+func isIntegerKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Uint64
+}
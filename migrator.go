@@ -1,25 +1,37 @@
 package migrator
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"strings"
+	"reflect"
+	"sort"
 	"time"
 
 	stormv05 "github.com/asdine/storm-migrator/v0.5"
 	"github.com/asdine/storm-migrator/v0.5/codec"
 	"github.com/asdine/storm-migrator/v0.5/codec/json"
-	stormv06 "github.com/asdine/storm-migrator/v0.6"
 	"github.com/boltdb/bolt"
 )
 
+// Storm v0.4 doesn't always store its version
+const defaultVersion = "0.4"
+
 // New instanciates a Migrator for the given database
 func New(path string) *Migrator {
 	return &Migrator{
 		path:       path,
 		kvKeys:     make(map[string][]interface{}),
+		kvFuncs:    make(map[string]func([]byte) (interface{}, error)),
+		kvValues:   make(map[string][]interface{}),
+		transforms: make(map[string]func(reflect.Value) (interface{}, error)),
 		forceCodec: json.Codec,
+		codecs:     make(map[string]codec.MarshalUnmarshaler),
+		registry:   DefaultRegistry(),
+
+		progressInterval: defaultProgressInterval,
+		ctx:              context.Background(),
 	}
 }
 
@@ -27,8 +39,41 @@ func New(path string) *Migrator {
 type Migrator struct {
 	path       string
 	instances  []interface{}
+	nodes      []Node
 	kvKeys     map[string][]interface{}
+	kvFuncs    map[string]func([]byte) (interface{}, error)
+	kvValues   map[string][]interface{}
+	transforms map[string]func(reflect.Value) (interface{}, error)
 	forceCodec codec.MarshalUnmarshaler
+	// codecs of the buckets that don't use forceCodec
+	codecs map[string]codec.MarshalUnmarshaler
+	detect bool
+	// buckets renamed before the migration, and the types registered with AddBucketAs
+	renames      []rename
+	renamedTypes []interface{}
+	// codec the database is converted to, if any
+	convertTo codec.MarshalUnmarshaler
+	registry  *Registry
+	target    string
+	downgrade bool
+	// compare the source and the destination after the migration
+	verifyAfterRun bool
+
+	resume           bool
+	compact          bool
+	onUnregistered   UnregisteredPolicy
+	batchSize        int
+	autoIncrement    bool
+	onEvent          func(Event)
+	progressInterval int
+	started          time.Time
+	// last step, bucket and number of records reported, to describe where an interrupted migration stopped
+	progress Event
+	ctx      context.Context
+	// history entry of the step being run
+	entry *HistoryEntry
+	// keys skipped during the migration, by bucket
+	unmatched map[string][][]byte
 }
 
 // AddBuckets registers buckets to migrate based on the given instances.
@@ -43,8 +88,69 @@ func (m *Migrator) AddKV(bucketName string, keyInstances []interface{}) {
 	m.kvKeys[bucketName] = append(m.kvKeys[bucketName], keyInstances...)
 }
 
+// AddKVFunc registers a bucket created using Set whose keys are decoded by the given function.
+// The function receives the keys as stored by Storm v0.4 and returns the decoded key, for example an int or a string.
+// It can be used when the type of the keys depends on their content, like a prefix.
+// Keys for which it returns an error are reported by Run.
+func (m *Migrator) AddKVFunc(bucketName string, fn func(rawKey []byte) (interface{}, error)) {
+	m.kvFuncs[bucketName] = fn
+}
+
+// kvBuckets returns the names of the buckets registered with AddKV or AddKVFunc.
+func (m *Migrator) kvBuckets() []string {
+	names := make([]string, 0, len(m.kvKeys)+len(m.kvFuncs))
+	for name := range m.kvKeys {
+		names = append(names, name)
+	}
+	for name := range m.kvFuncs {
+		if _, ok := m.kvKeys[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// decodeKVKey decodes a key of a bucket registered with AddKV or AddKVFunc, stored by the given version.
+func (m *Migrator) decodeKVKey(version, bucketName string, k []byte) (interface{}, bool) {
+	fn, ok := m.kvFuncs[bucketName]
+	if !ok || binaryKeys(version) {
+		return decodeKey(version, k, m.kvKeys[bucketName], m.forceCodec)
+	}
+
+	key, err := fn(k)
+	if err != nil || key == nil {
+		return nil, false
+	}
+
+	return reflect.Indirect(reflect.ValueOf(key)).Interface(), true
+}
+
+// RegisterStep registers a custom migration step alongside the built-in ones.
+// It can be used to run application level migrations between two versions.
+func (m *Migrator) RegisterStep(s Step) error {
+	return m.registry.Register(s)
+}
+
+// RegisterDowngradeStep registers a custom step that migrates a database back to an older version.
+func (m *Migrator) RegisterDowngradeStep(s Step) error {
+	return m.registry.RegisterDowngrade(s)
+}
+
 // Run the migration.
 func (m *Migrator) Run(dst string, options ...func(*Migrator) error) error {
+	return m.RunContext(context.Background(), dst, options...)
+}
+
+// RunContext works like Run but stops as soon as the context is done, between two records.
+// The current transaction is rolled back and an *InterruptedError wrapping the error of the context is returned.
+// The destination is removed, unless the Resume option is used: it is then kept with a checkpoint
+// and running the migration again with Resume picks up where it stopped.
+func (m *Migrator) RunContext(ctx context.Context, dst string, options ...func(*Migrator) error) error {
+	m.started = time.Now()
+	m.ctx = ctx
+	m.progress = Event{}
+
 	for _, option := range options {
 		err := option(m)
 		if err != nil {
@@ -52,9 +158,21 @@ func (m *Migrator) Run(dst string, options ...func(*Migrator) error) error {
 		}
 	}
 
+	err := m.run(dst)
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return m.interrupted(dst)
+	}
+
+	return err
+}
+
+func (m *Migrator) run(dst string) error {
+	m.unmatched = nil
+
 	_, err := os.Stat(dst)
-	if err == nil {
-		return fmt.Errorf("Path \"%s\" already exists.", dst)
+	resume := err == nil && m.resume
+	if err == nil && !resume {
+		return fmt.Errorf("%w: %s", ErrDestinationExists, dst)
 	}
 
 	err = m.checkSourceDB()
@@ -62,42 +180,194 @@ func (m *Migrator) Run(dst string, options ...func(*Migrator) error) error {
 		return err
 	}
 
-	err = m.copyDB(dst)
+	skipped, err := m.checkUnregistered()
+	if err != nil {
+		return err
+	}
+
+	err = m.checkConvert()
 	if err != nil {
 		return err
 	}
 
+	if m.detect {
+		err = m.detectSourceCodecs()
+		if err != nil {
+			return err
+		}
+	}
+
+	// make sure the target can be reached before creating anything
+	_, steps, err := m.sourcePath()
+	if err != nil {
+		return err
+	}
+
+	// the transforms are applied by the first step from the source version
+	var first Step
+	if len(steps) > 0 {
+		first = steps[0]
+	}
+
+	if !resume {
+		err = m.copyDB(dst)
+		if err != nil {
+			return err
+		}
+	}
+
 	b, err := bolt.Open(dst, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		return err
 	}
 	defer b.Close()
 
-	for {
+	if resume {
+		// the steps already done are reflected by the version of the destination
 		version, err := m.getVersion(b)
 		if err != nil {
-			fmt.Println("1")
 			return err
 		}
 
-		switch {
-		case strings.HasPrefix(version, "0.4"):
-			migrator := stormv05.NewMigrator(b, m.forceCodec)
-			err = migrator.Run(m.instances, m.kvKeys)
-		case strings.HasPrefix(version, "0.5"):
-			migrator := stormv06.NewMigrator(b, m.forceCodec)
-			err = migrator.Run(m.instances, m.kvKeys)
-		case strings.HasPrefix(version, "0.6"):
-			return nil
-		default:
-			migrator := stormv05.NewMigrator(b, m.forceCodec)
-			err = migrator.Run(m.instances, m.kvKeys)
+		steps, err = m.pathFrom(version)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dropBuckets(b, skipped)
+	if err != nil {
+		return err
+	}
+
+	err = m.renameBuckets(b)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := m.expandNodes(b)
+	if err != nil {
+		return err
+	}
+
+	ctx := Context{
+		Codec:         m.forceCodec,
+		Codecs:        m.codecs,
+		Instances:     m.instances,
+		Nodes:         nodes,
+		KV:            m.kvKeys,
+		KVFuncs:       m.kvFuncs,
+		Emit:          m.emit,
+		Raw:           m.onUnregistered == RawMigrate,
+		BatchSize:     m.batchSize,
+		AutoIncrement: m.autoIncrement,
+		Context:       m.ctx,
+	}
+
+	for _, step := range steps {
+		err = m.ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		m.emit(Event{Type: StepStarted, From: step.FromVersion(), To: step.ToVersion()})
+
+		err = startStep(b, step)
+		if err != nil {
+			return err
+		}
+		m.startHistory(step)
+
+		sctx := ctx
+		if first != nil && step.FromVersion() == first.FromVersion() && step.ToVersion() == first.ToVersion() {
+			sctx.Transforms = m.transforms
+		}
+
+		err = step.Run(b, sctx)
+		if err != nil {
+			return m.migrationError(step.FromVersion(), step.ToVersion(), err)
+		}
+
+		// make sure the version is bumped, even if the step didn't do it
+		err = m.ensureVersion(b, step.ToVersion())
+		if err != nil {
+			return err
+		}
+
+		err = m.writeHistory(b)
+		if err != nil {
+			return err
+		}
+
+		m.emit(Event{Type: StepFinished, From: step.FromVersion(), To: step.ToVersion()})
+	}
+
+	if first == nil {
+		err = m.applyTransforms(b)
+		if err != nil {
+			return m.migrationError("", "", err)
+		}
+	}
+
+	err = m.resaveRenamed(b)
+	if err != nil {
+		return m.migrationError("", "", err)
+	}
+
+	if m.convertTo != nil {
+		err = m.convertCodec(b)
+		if err != nil {
+			return m.migrationError("", "", err)
 		}
+	}
 
+	err = clearCheckpoint(b)
+	if err != nil {
+		return err
+	}
+
+	if m.verifyAfterRun {
+		err = m.verifyMigrated(b)
 		if err != nil {
 			return err
 		}
 	}
+
+	if len(m.unmatched) > 0 {
+		return &UnmatchedKeysError{Keys: m.unmatched}
+	}
+
+	return nil
+}
+
+// verifyMigrated compares the source with the migrated database.
+func (m *Migrator) verifyMigrated(b *bolt.DB) error {
+	src, err := openSource(m.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	report, err := m.verify(src, b)
+	if err != nil {
+		return err
+	}
+
+	if !report.OK() {
+		return &VerificationError{Report: report}
+	}
+
+	return nil
+}
+
+// openSource opens the source database read-only.
+func openSource(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%w: %s", ErrSourceLocked, path)
+	}
+
+	return db, err
 }
 
 func (m *Migrator) checkSourceDB() error {
@@ -106,7 +376,7 @@ func (m *Migrator) checkSourceDB() error {
 		return err
 	}
 
-	db, err := bolt.Open(m.path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	db, err := openSource(m.path)
 	if err != nil {
 		return err
 	}
@@ -114,35 +384,135 @@ func (m *Migrator) checkSourceDB() error {
 	return db.Close()
 }
 
-func (m *Migrator) copyDB(path string) error {
-	dst, err := os.Create(path)
+// sourcePath detects the version of the source database and returns the steps
+// needed to migrate it to the target version.
+func (m *Migrator) sourcePath() (string, []Step, error) {
+	b, err := openSource(m.path)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
+	defer b.Close()
 
-	src, err := os.Open(m.path)
+	version, err := m.getVersion(b)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
-	_, err = io.Copy(dst, src)
+	steps, err := m.pathFrom(version)
+	return version, steps, err
+}
+
+// pathFrom returns the steps needed to migrate a database at the given version to the target version.
+func (m *Migrator) pathFrom(version string) ([]Step, error) {
+	steps, err := m.registry.Path(version, m.target)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return dst.Sync()
+	if len(steps) > 0 && isDowngrade(steps[0]) && !m.downgrade {
+		return nil, fmt.Errorf("%w: %s is newer than %s, use the Downgrade option", ErrNewerThanTarget, version, m.target)
+	}
+
+	return steps, nil
 }
 
 func (m *Migrator) getVersion(b *bolt.DB) (string, error) {
-	db, err := stormv05.Open("", stormv05.UseDB(b))
+	v := defaultVersion
+
+	err := b.View(func(tx *bolt.Tx) error {
+		// Storm v0.5 and later store their version in the dbinfo bucket,
+		// Storm v0.4 in the global metadata bucket
+		for _, name := range []string{dbinfoBucket, metadataBucket} {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+
+			raw := bucket.Get([]byte("version"))
+			if raw == nil {
+				continue
+			}
+
+			if s, ok := m.decodeVersion(raw); ok {
+				v = s
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return v, err
+}
+
+// decodeVersion decodes the version with the codec of the source
+// or the codec the database is converted to.
+func (m *Migrator) decodeVersion(raw []byte) (string, bool) {
+	for _, c := range []codec.MarshalUnmarshaler{m.forceCodec, m.convertTo} {
+		var v string
+		if c != nil && c.Unmarshal(raw, &v) == nil && v != "" {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+func (m *Migrator) ensureVersion(b *bolt.DB, version string) error {
+	v, err := m.getVersion(b)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	var v string
-	_ = db.Get("__storm_db", "version", &v)
+	if matchVersion(version, v) {
+		return nil
+	}
 
-	return v, nil
+	db, err := stormv05.Open("", stormv05.UseDB(b), stormv05.Codec(m.forceCodec))
+	if err != nil {
+		return err
+	}
+
+	return db.Set(dbinfoBucket, "version", version)
+}
+
+// Resume option allows running the migration on a destination left by an interrupted migration.
+// The migration continues where it stopped instead of failing because the destination already exists.
+func Resume() func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.resume = true
+		return nil
+	}
+}
+
+// Compact option rewrites every bucket of the source into a fresh file instead of copying it as is.
+// The free pages of the source are not copied and the destination is as small as possible.
+func Compact() func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.compact = true
+		return nil
+	}
+}
+
+// BatchSize option sets the number of records saved in a single transaction when re-saving the records of a bucket.
+// Bigger batches are faster but use more memory. The default is 1000.
+func BatchSize(n int) func(*Migrator) error {
+	return func(m *Migrator) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid batch size %d", n)
+		}
+		m.batchSize = n
+		return nil
+	}
+}
+
+// AutoIncrement option tells that the migrated database is opened with the AutoIncrement option of Storm.
+// The counters used by Storm v0.6 to increment the integer ids are then seeded for every bucket,
+// and not only for the ids with the increment tag or the buckets whose sequence was used by Storm v0.5.
+func AutoIncrement() func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.autoIncrement = true
+		return nil
+	}
 }
 
 // Codec option forces the codec used for the whole migration
@@ -152,3 +522,20 @@ func Codec(codec codec.MarshalUnmarshaler) func(*Migrator) error {
 		return nil
 	}
 }
+
+// TargetVersion option stops the migration once the database reaches the given version.
+// By default, the database is migrated to the latest version.
+func TargetVersion(version string) func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.target = version
+		return nil
+	}
+}
+
+// Downgrade option allows migrating the database to an older version given by TargetVersion.
+func Downgrade() func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.downgrade = true
+		return nil
+	}
+}
@@ -1,6 +1,8 @@
 package migrator_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -13,6 +15,7 @@ import (
 	stormv04 "github.com/asdine/storm-migrator/v0.4"
 	stormv05 "github.com/asdine/storm-migrator/v0.5"
 	"github.com/asdine/storm-migrator/v0.5/codec/json"
+	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/require"
 )
 
@@ -74,6 +77,296 @@ func TestMigrator(t *testing.T) {
 	}
 }
 
+func TestTargetVersion(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err := m.Run(filepath.Join(dir, "v05.db"), migrator.TargetVersion("0.5"))
+	require.NoError(t, err)
+
+	db, err := stormv05.Open(filepath.Join(dir, "v05.db"))
+	require.NoError(t, err)
+
+	var version string
+	err = db.Get("__storm_db", "version", &version)
+	require.NoError(t, err)
+	require.Equal(t, "0.5.0", version)
+
+	var a A
+	err = db.One("ID", 1, &a)
+	require.NoError(t, err)
+	db.Close()
+
+	m = migrator.New(filepath.Join(dir, "v05.db"))
+	err = m.Run(filepath.Join(dir, "other.db"), migrator.TargetVersion("0.4"))
+	require.True(t, errors.Is(err, migrator.ErrNewerThanTarget))
+	_, err = os.Stat(filepath.Join(dir, "other.db"))
+	require.True(t, os.IsNotExist(err))
+
+	err = m.Run(filepath.Join(dir, "other.db"), migrator.TargetVersion("0.9"))
+	require.True(t, errors.Is(err, migrator.ErrUnknownVersion))
+	_, err = os.Stat(filepath.Join(dir, "other.db"))
+	require.True(t, os.IsNotExist(err))
+
+	err = m.Run(filepath.Join(dir, "v05-copy.db"), migrator.TargetVersion("0.5"))
+	require.NoError(t, err)
+}
+
+func TestDowngrade(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err := m.Run(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+
+	m = migrator.New(filepath.Join(dir, "v06.db"))
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Run(filepath.Join(dir, "old.db"), migrator.TargetVersion("0.4"))
+	require.True(t, errors.Is(err, migrator.ErrNewerThanTarget))
+
+	err = m.Run(filepath.Join(dir, "old.db"), migrator.TargetVersion("0.4"), migrator.Downgrade())
+	require.NoError(t, err)
+
+	db, err := stormv04.Open(filepath.Join(dir, "old.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		var a A
+		err = db.One("ID", i+1, &a)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("Field%d", i), a.Field1)
+
+		var b B
+		err = db.One("ID", strconv.Itoa(i+1), &b)
+		require.NoError(t, err)
+		require.Equal(t, int64(i*10), b.Field1)
+
+		var v int
+		if i%2 == 0 {
+			err = db.Get("bucket", fmt.Sprintf("string%d", i), &v)
+		} else {
+			err = db.Get("bucket", i+11, &v)
+		}
+		require.NoError(t, err)
+		require.Equal(t, i, v)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+
+	// simulate a crash in the middle of the first bucket
+	func() {
+		defer func() {
+			require.Equal(t, "crash", recover())
+		}()
+
+		m.Run(filepath.Join(dir, "v06.db"), migrator.BatchSize(1), migrator.ProgressInterval(1), migrator.OnEvent(func(e migrator.Event) {
+			if e.Type == migrator.RecordsProcessed && e.Bucket == "A" && e.Records == 5 {
+				panic("crash")
+			}
+		}))
+	}()
+
+	err := m.Run(filepath.Join(dir, "v06.db"))
+	require.Error(t, err)
+
+	var events []migrator.Event
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.Resume(), migrator.OnEvent(func(e migrator.Event) {
+		if e.Type == migrator.BucketFinished && e.To == "0.5" {
+			events = append(events, e)
+		}
+	}))
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	require.Equal(t, "A", events[0].Bucket)
+	require.Equal(t, 5, events[0].Records)
+
+	r, err := m.Verify(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	require.True(t, r.OK(), r.String())
+
+	// resuming a finished migration does nothing
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.Resume())
+	require.NoError(t, err)
+
+	db, err := stormv05.Open(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var version string
+	err = db.Get("__storm_db", "version", &version)
+	require.NoError(t, err)
+	require.Equal(t, "0.6.0", version)
+}
+
+func TestRunInPlace(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	before, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	// a failing step leaves the source untouched
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.RegisterStep(&testStep{from: "0.6", to: "0.6.0-app.1", run: func(*bolt.DB, migrator.Context) error {
+		return errors.New("failure")
+	}})
+	require.NoError(t, err)
+	err = m.RunInPlace()
+	require.EqualError(t, err, "step 0.6 -> 0.6.0-app.1: failure")
+
+	after, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.RunInPlace()
+	require.NoError(t, err)
+
+	backup, err := stormv04.Open(path + ".bak-" + stormv04.Version)
+	require.NoError(t, err)
+	var list []A
+	err = backup.All(&list)
+	require.NoError(t, err)
+	require.Len(t, list, 10)
+	backup.Close()
+
+	// already up to date
+	err = m.RunInPlace()
+	require.NoError(t, err)
+
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	db, err := stormv05.Open(path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var version string
+	err = db.Get("__storm_db", "version", &version)
+	require.NoError(t, err)
+	require.Equal(t, "0.6.0", version)
+
+	var a A
+	err = db.One("ID", 1, &a)
+	require.NoError(t, err)
+}
+
+func TestCompact(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	// leave a lot of free pages in the source
+	b, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	err = b.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("junk"))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < 1000; i++ {
+			err = bucket.Put([]byte(strconv.Itoa(i)), make([]byte, 1024))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	err = b.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("junk"))
+	})
+	require.NoError(t, err)
+	b.Close()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Run(filepath.Join(dir, "copy.db"))
+	require.NoError(t, err)
+
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Run(filepath.Join(dir, "compact.db"), migrator.Compact(), migrator.Verify())
+	require.NoError(t, err)
+
+	copied, err := os.Stat(filepath.Join(dir, "copy.db"))
+	require.NoError(t, err)
+	compacted, err := os.Stat(filepath.Join(dir, "compact.db"))
+	require.NoError(t, err)
+	require.True(t, compacted.Size() < copied.Size())
+}
+
+func TestAddKVFunc(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	err = dbv04.Set("mixed", "s:123", 1)
+	require.NoError(t, err)
+	err = dbv04.Set("mixed", 123, 2)
+	require.NoError(t, err)
+	err = dbv04.Set("mixed", "unknown", 3)
+	require.NoError(t, err)
+	dbv04.Close()
+
+	m := migrator.New(path)
+	m.AddKVFunc("mixed", func(k []byte) (interface{}, error) {
+		if bytes.HasPrefix(k, []byte("s:")) {
+			return string(k), nil
+		}
+		return strconv.Atoi(string(k))
+	})
+
+	r, err := m.Plan()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("unknown")}, r.Buckets[0].UndecodableKeys)
+
+	err = m.Run(filepath.Join(dir, "v06.db"))
+	var uerr *migrator.UnmatchedKeysError
+	require.True(t, errors.As(err, &uerr))
+	require.Equal(t, map[string][][]byte{"mixed": {[]byte("unknown")}}, uerr.Keys)
+
+	db, err := stormv05.Open(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var v int
+	err = db.Get("mixed", "s:123", &v)
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+
+	err = db.Get("mixed", 123, &v)
+	require.NoError(t, err)
+	require.Equal(t, 2, v)
+}
+
 func prepareDB(t *testing.T) (string, string, func()) {
 	dir, err := ioutil.TempDir(os.TempDir(), "storm-migrator")
 	require.NoError(t, err)
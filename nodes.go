@@ -0,0 +1,118 @@
+package migrator
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Wildcard matches every child bucket of a node when used in a node path.
+const Wildcard = "*"
+
+// Node groups the buckets registered under the same node path.
+type Node struct {
+	// Path of the node, as given to the Root or From methods of Storm
+	Path []string
+	// Instances registered with AddBucketsAt
+	Instances []interface{}
+	// Key instances registered with AddKVAt, by bucket name
+	KV map[string][]interface{}
+}
+
+// AddBucketsAt registers buckets to migrate that are nested under the node at the given path,
+// created using the Root or From methods. Any element of the path can be a Wildcard,
+// which matches every child bucket of the node, for example []string{"tenants", "*"}.
+func (m *Migrator) AddBucketsAt(path []string, instances ...interface{}) {
+	n := m.node(path)
+	n.Instances = append(n.Instances, instances...)
+}
+
+// AddKVAt registers a bucket created using Set nested under the node at the given path,
+// like AddKV. The path can contain wildcards, as with AddBucketsAt.
+func (m *Migrator) AddKVAt(path []string, bucketName string, keyInstances []interface{}) {
+	n := m.node(path)
+	n.KV[bucketName] = append(n.KV[bucketName], keyInstances...)
+}
+
+// node returns the node registered with the given path, creating it if needed.
+func (m *Migrator) node(path []string) *Node {
+	for i := range m.nodes {
+		if strings.Join(m.nodes[i].Path, "/") == strings.Join(path, "/") {
+			return &m.nodes[i]
+		}
+	}
+
+	m.nodes = append(m.nodes, Node{
+		Path: append([]string(nil), path...),
+		KV:   make(map[string][]interface{}),
+	})
+	return &m.nodes[len(m.nodes)-1]
+}
+
+// expandNodes returns the registered nodes with their wildcards replaced by the matching buckets
+// of the database. Nodes that don't exist are left out.
+func (m *Migrator) expandNodes(b *bolt.DB) ([]Node, error) {
+	var nodes []Node
+
+	err := b.View(func(tx *bolt.Tx) error {
+		for _, n := range m.nodes {
+			for _, path := range expandPath(tx, n.Path) {
+				nodes = append(nodes, Node{Path: path, Instances: n.Instances, KV: n.KV})
+			}
+		}
+		return nil
+	})
+
+	return nodes, err
+}
+
+// expandPath returns the paths of the existing buckets matching the given path.
+// Wildcards only match buckets that were not created by Storm for its own needs.
+func expandPath(tx *bolt.Tx, path []string) [][]string {
+	var paths [][]string
+
+	var walk func(b *bolt.Bucket, prefix []string, rest []string)
+	walk = func(b *bolt.Bucket, prefix []string, rest []string) {
+		if len(rest) == 0 {
+			paths = append(paths, prefix)
+			return
+		}
+
+		child := func(name []byte) *bolt.Bucket {
+			if b == nil {
+				return tx.Bucket(name)
+			}
+			return b.Bucket(name)
+		}
+
+		if rest[0] != Wildcard {
+			if c := child([]byte(rest[0])); c != nil {
+				walk(c, append(prefix[:len(prefix):len(prefix)], rest[0]), rest[1:])
+			}
+			return
+		}
+
+		var names [][]byte
+		fn := func(k, v []byte) error {
+			if v == nil && !bytes.HasPrefix(k, []byte("__storm")) {
+				names = append(names, append([]byte(nil), k...))
+			}
+			return nil
+		}
+		if b == nil {
+			_ = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				return fn(name, nil)
+			})
+		} else {
+			_ = b.ForEach(fn)
+		}
+
+		for _, name := range names {
+			walk(child(name), append(prefix[:len(prefix):len(prefix)], string(name)), rest[1:])
+		}
+	}
+
+	walk(nil, nil, path)
+	return paths
+}
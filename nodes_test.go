@@ -0,0 +1,106 @@
+package migrator_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddBucketsAt(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for _, tenant := range []string{"1", "2", "3"} {
+		n := dbv04.From("tenants", tenant)
+		for i := 0; i < 5; i++ {
+			err = n.Save(&Indexed{ID: i + 1, Name: fmt.Sprintf("%s-name%d", tenant, i%2)})
+			require.NoError(t, err)
+		}
+		err = n.Set("settings", 10, tenant)
+		require.NoError(t, err)
+	}
+	err = dbv04.From("app", "users").Save(&A{ID: 1, Field1: "nested"})
+	require.NoError(t, err)
+	dbv04.Close()
+
+	var buckets []string
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddBucketsAt([]string{"tenants", migrator.Wildcard}, new(Indexed))
+	m.AddKVAt([]string{"tenants", "*"}, "settings", []interface{}{new(int)})
+	m.AddBucketsAt([]string{"app", "users"}, new(A))
+	m.AddBucketsAt([]string{"missing", "*"}, new(A))
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.OnEvent(func(e migrator.Event) {
+		if e.Type == migrator.BucketStarted && e.To == "0.5" {
+			buckets = append(buckets, e.Bucket)
+		}
+	}))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"tenants/1/Indexed", "tenants/1/settings",
+		"tenants/2/Indexed", "tenants/2/settings",
+		"tenants/3/Indexed", "tenants/3/settings",
+		"app/users/A",
+		"A", "B",
+	}, buckets)
+
+	db, err := stormv06.Open(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+
+	for _, tenant := range []string{"1", "2", "3"} {
+		n := db.From("tenants", tenant)
+
+		var list []Indexed
+		err = n.Find("Name", tenant+"-name0", &list)
+		require.NoError(t, err)
+		require.Len(t, list, 3)
+
+		var v string
+		err = n.Get("settings", 10, &v)
+		require.NoError(t, err)
+		require.Equal(t, tenant, v)
+	}
+
+	var a A
+	err = db.From("app", "users").One("ID", 1, &a)
+	require.NoError(t, err)
+	require.Equal(t, "nested", a.Field1)
+
+	err = db.One("ID", 1, &a)
+	require.NoError(t, err)
+	require.Equal(t, "Field0", a.Field1)
+
+	// the nested buckets are verified with their full path
+	err = db.From("tenants", "2").DeleteStruct(&Indexed{ID: 3})
+	require.NoError(t, err)
+	db.Close()
+
+	r, err := m.Verify(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	require.False(t, r.OK())
+	var names []string
+	for _, d := range r.Buckets {
+		names = append(names, d.Name)
+		if d.Name == "tenants/2/Indexed" {
+			require.Equal(t, []string{"3"}, d.Missing)
+		} else {
+			require.True(t, d.OK(), d.Name)
+		}
+	}
+	require.Equal(t, []string{
+		"A", "B",
+		"tenants/1/Indexed", "tenants/1/settings",
+		"tenants/2/Indexed", "tenants/2/settings",
+		"tenants/3/Indexed", "tenants/3/settings",
+		"app/users/A",
+	}, names)
+	require.Equal(t, []string{"bucket"}, r.Unverified)
+	require.Contains(t, r.String(), "unverified: bucket")
+}
@@ -0,0 +1,259 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	dbinfoBucket   = "__storm_db"
+	metadataBucket = "__storm_metadata"
+	indexPrefix    = "__storm_index_"
+)
+
+// Kinds of buckets
+const (
+	// TypeBucket is a bucket created with Save or Init
+	TypeBucket = "type"
+	// KVBucket is a bucket created with Set
+	KVBucket = "kv"
+)
+
+// Report describes what Run would do on the source database.
+type Report struct {
+	// Path of the source database
+	Path string `json:"path"`
+	// Version of Storm detected in the source database
+	Version string `json:"version"`
+	// Steps that would be executed, in order
+	Steps []StepReport `json:"steps"`
+	// Buckets registered with AddBuckets and AddKV
+	Buckets []BucketReport `json:"buckets"`
+	// Top level buckets found in the source database that were not registered
+	Unregistered []string `json:"unregistered,omitempty"`
+	// Kind of each unregistered bucket: TypeBucket, KVBucket or ForeignBucket, by bucket name
+	UnregisteredKinds map[string]string `json:"unregistered_kinds,omitempty"`
+}
+
+// StepReport describes a single migration step.
+type StepReport struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// BucketReport describes the content of a registered bucket.
+type BucketReport struct {
+	Name string `json:"name"`
+	// TypeBucket, KVBucket or ForeignBucket
+	Kind string `json:"kind"`
+	// False if the bucket doesn't exist in the source database
+	Exists bool `json:"exists"`
+	// Number of records or key value pairs
+	Records int `json:"records"`
+	// Names of the indexed fields
+	Indexes []string `json:"indexes,omitempty"`
+	// Name of the codec stored in the metadata of the bucket, if any
+	Codec string `json:"codec,omitempty"`
+	// Keys that none of the instances registered with AddKV can decode
+	UndecodableKeys [][]byte `json:"undecodable_keys,omitempty"`
+}
+
+// String returns a printable version of the report.
+func (r *Report) String() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Source: %s\n", r.Path)
+	fmt.Fprintf(&buf, "Version: %s\n", r.Version)
+
+	fmt.Fprintln(&buf, "Steps:")
+	if len(r.Steps) == 0 {
+		fmt.Fprintln(&buf, "  none, the database is up to date")
+	}
+	for _, s := range r.Steps {
+		fmt.Fprintf(&buf, "  %s -> %s\n", s.From, s.To)
+	}
+
+	fmt.Fprintln(&buf, "Buckets:")
+	for _, b := range r.Buckets {
+		if !b.Exists {
+			fmt.Fprintf(&buf, "  %s (%s): not found\n", b.Name, b.Kind)
+			continue
+		}
+
+		fmt.Fprintf(&buf, "  %s (%s): %d records", b.Name, b.Kind, b.Records)
+		if b.Codec != "" {
+			fmt.Fprintf(&buf, ", codec: %s", b.Codec)
+		}
+		if len(b.Indexes) > 0 {
+			fmt.Fprintf(&buf, ", indexes: %s", strings.Join(b.Indexes, ", "))
+		}
+		if len(b.UndecodableKeys) > 0 {
+			fmt.Fprintf(&buf, ", %d undecodable keys", len(b.UndecodableKeys))
+		}
+		fmt.Fprintln(&buf)
+		for _, k := range b.UndecodableKeys {
+			fmt.Fprintf(&buf, "    undecodable key %q\n", k)
+		}
+	}
+
+	if len(r.Unregistered) > 0 {
+		fmt.Fprintln(&buf, "Unregistered buckets:")
+		for _, name := range r.Unregistered {
+			fmt.Fprintf(&buf, "  %s (%s)\n", name, r.UnregisteredKinds[name])
+		}
+	}
+
+	return buf.String()
+}
+
+// Plan inspects the source database and reports what Run would do.
+// The source database is opened in read-only mode and nothing is written.
+func (m *Migrator) Plan(options ...func(*Migrator) error) (*Report, error) {
+	for _, option := range options {
+		err := option(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := m.checkSourceDB()
+	if err != nil {
+		return nil, err
+	}
+
+	version, steps, err := m.sourcePath()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := openSource(m.path)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	r := Report{
+		Path:    m.path,
+		Version: version,
+	}
+
+	for _, s := range steps {
+		r.Steps = append(r.Steps, StepReport{From: s.FromVersion(), To: s.ToVersion()})
+	}
+
+	// keys are only converted when migrating from v0.4
+	convertKeys := len(r.Steps) > 0 && r.Steps[0].From == "0.4"
+
+	err = b.View(func(tx *bolt.Tx) error {
+		for _, inst := range m.instances {
+			br := inspectTypeBucket(tx, m.sourceName(bucketName(inst)))
+			br.Name = bucketName(inst)
+			r.Buckets = append(r.Buckets, br)
+		}
+
+		// the nested buckets are not inspected
+		for _, name := range m.kvBuckets() {
+			br := BucketReport{Name: name, Kind: KVBucket}
+			bucket := tx.Bucket([]byte(m.sourceName(name)))
+			if bucket != nil {
+				br.Exists = true
+				err := bucket.ForEach(func(k, v []byte) error {
+					if v == nil {
+						return nil
+					}
+					br.Records++
+					if !convertKeys {
+						return nil
+					}
+					if _, ok := m.decodeKVKey(version, name, k); !ok {
+						br.UndecodableKeys = append(br.UndecodableKeys, append([]byte(nil), k...))
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			r.Buckets = append(r.Buckets, br)
+		}
+
+		r.UnregisteredKinds = m.unregistered(tx)
+		for name := range r.UnregisteredKinds {
+			r.Unregistered = append(r.Unregistered, name)
+		}
+		sort.Strings(r.Unregistered)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// Inspect reports like Plan and describes the unregistered buckets as well: they are added to the buckets
+// of the report, with the kind guessed from their content. It can be used without registering anything.
+func (m *Migrator) Inspect(options ...func(*Migrator) error) (*Report, error) {
+	r, err := m.Plan(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := openSource(m.path)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	err = b.View(func(tx *bolt.Tx) error {
+		for _, name := range r.Unregistered {
+			br := inspectTypeBucket(tx, name)
+			br.Kind = r.UnregisteredKinds[name]
+			r.Buckets = append(r.Buckets, br)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func inspectTypeBucket(tx *bolt.Tx, name string) BucketReport {
+	br := BucketReport{Name: name, Kind: TypeBucket}
+
+	bucket := tx.Bucket([]byte(name))
+	if bucket == nil {
+		return br
+	}
+
+	br.Exists = true
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil {
+			br.Records++
+			continue
+		}
+
+		if bytes.HasPrefix(k, []byte(indexPrefix)) {
+			br.Indexes = append(br.Indexes, string(k[len(indexPrefix):]))
+		}
+	}
+
+	if meta := bucket.Bucket([]byte(metadataBucket)); meta != nil {
+		br.Codec = string(meta.Get([]byte("codec")))
+	}
+
+	return br
+}
+
+// bucketName returns the name of the bucket Storm uses for the given instance.
+func bucketName(inst interface{}) string {
+	return reflect.Indirect(reflect.ValueOf(inst)).Type().Name()
+}
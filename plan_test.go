@@ -0,0 +1,86 @@
+package migrator_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	err = dbv04.Set("other", "key", "value")
+	require.NoError(t, err)
+	err = dbv04.Set("bucket", []int{1, 2}, "value")
+	require.NoError(t, err)
+	dbv04.Close()
+
+	before, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int)})
+	m.AddKV("missing", []interface{}{new(string)})
+
+	r, err := m.Plan()
+	require.NoError(t, err)
+	require.Equal(t, path, r.Path)
+	require.Equal(t, stormv04.Version, r.Version)
+	require.Equal(t, []migrator.StepReport{{From: "0.4", To: "0.5"}, {From: "0.5", To: "0.6"}}, r.Steps)
+	require.Len(t, r.Buckets, 4)
+
+	require.Equal(t, "A", r.Buckets[0].Name)
+	require.Equal(t, migrator.TypeBucket, r.Buckets[0].Kind)
+	require.True(t, r.Buckets[0].Exists)
+	require.Equal(t, 10, r.Buckets[0].Records)
+
+	require.Equal(t, "B", r.Buckets[1].Name)
+	require.Equal(t, 10, r.Buckets[1].Records)
+
+	require.Equal(t, "bucket", r.Buckets[2].Name)
+	require.Equal(t, migrator.KVBucket, r.Buckets[2].Kind)
+	require.Equal(t, 21, r.Buckets[2].Records)
+	// string keys and the slice key can't be decoded as int
+	require.Len(t, r.Buckets[2].UndecodableKeys, 11)
+	require.Contains(t, r.Buckets[2].UndecodableKeys, []byte("[1,2]"))
+
+	require.Equal(t, "missing", r.Buckets[3].Name)
+	require.False(t, r.Buckets[3].Exists)
+
+	require.Equal(t, []string{"other"}, r.Unregistered)
+	require.Contains(t, r.String(), "0.4 -> 0.5")
+	require.Contains(t, r.String(), "other")
+
+	after, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	_, err = os.Stat(filepath.Join(dir, "v05.db"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestPlanUpToDate(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err := m.Run(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+
+	r, err := migrator.New(filepath.Join(dir, "v06.db")).Plan()
+	require.NoError(t, err)
+	require.Equal(t, "0.6.0", r.Version)
+	require.Empty(t, r.Steps)
+	require.Equal(t, []string{"A", "B", "bucket"}, r.Unregistered)
+}
@@ -0,0 +1,747 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/asdine/storm-migrator/v0.5/codec"
+	indexv05 "github.com/asdine/storm-migrator/v0.5/index"
+	indexv06 "github.com/asdine/storm-migrator/v0.6/index"
+	"github.com/boltdb/bolt"
+)
+
+// Bucket used by list indexes to map ids to values
+const listIDs = "storm__ids"
+
+// Raw option migrates the buckets created with Save or Init that were not registered with AddBuckets.
+// These buckets are detected by their indexes and migrated without knowing their type:
+// records are decoded generically with the codec, ids and indexes are rewritten at the byte level.
+// Codecs that can't decode a record without its type, like gob and protobuf, are not supported
+// when migrating from Storm v0.4: Run fails before writing anything.
+// Integer ids and indexed values are converted to 64 bits integers, types with smaller integer ids
+// or buckets without indexes must still be registered with AddBuckets.
+// It is the same as OnUnregistered(RawMigrate).
+func Raw() func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.onUnregistered = RawMigrate
+		return nil
+	}
+}
+
+// rawBuckets returns the buckets that contain Storm indexes but that were not registered.
+func rawBuckets(tx *bolt.Tx, ctx Context) []string {
+	registered := map[string]bool{
+		dbinfoBucket:   true,
+		metadataBucket: true,
+		historyBucket:  true,
+	}
+	for _, inst := range ctx.Instances {
+		registered[bucketName(inst)] = true
+	}
+	for name := range ctx.KV {
+		registered[name] = true
+	}
+
+	var list []string
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if registered[string(name)] {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(indexPrefix)); bytes.HasPrefix(k, []byte(indexPrefix)); k, v = c.Next() {
+			if v == nil {
+				list = append(list, string(name))
+				break
+			}
+		}
+		return nil
+	})
+
+	return list
+}
+
+// migrateRaw applies fn to every raw bucket, including the ones whose migration was interrupted.
+func migrateRaw(db *bolt.DB, ctx Context, fn func(*bolt.DB, Context, string) error) error {
+	var names []string
+	err := db.View(func(tx *bolt.Tx) error {
+		names = rawBuckets(tx, ctx)
+
+		staging := tx.Bucket([]byte(rawStaging))
+		if staging == nil {
+			return nil
+		}
+
+		return staging.ForEach(func(k, v []byte) error {
+			if v == nil && tx.Bucket(k) == nil {
+				names = append(names, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if ctx.BatchSize <= 0 {
+		ctx.BatchSize = defaultRawBatchSize
+	}
+
+	for _, name := range names {
+		err = ctx.Context.Err()
+		if err != nil {
+			return err
+		}
+
+		err = fn(db, ctx, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Number of records of a raw bucket saved in a single transaction if the BatchSize option isn't used.
+const defaultRawBatchSize = 1000
+
+var errRawCodec = errors.New("the records can't be decoded without their type")
+
+// genericCodec reports whether the codec can decode a record without knowing its type,
+// as done when migrating the raw buckets to Storm v0.5 and when dumping the unregistered buckets.
+func genericCodec(c codec.MarshalUnmarshaler) bool {
+	raw, err := c.Marshal(struct{ ID int }{ID: 1})
+	if err != nil {
+		return false
+	}
+
+	var record map[string]interface{}
+	return c.Unmarshal(raw, &record) == nil
+}
+
+// checkRawCodec fails if the buckets created with Save or Init that were not registered
+// must be migrated without their type to Storm v0.5 and the codec can't decode them.
+func (m *Migrator) checkRawCodec(buckets map[string]string) error {
+	if genericCodec(m.forceCodec) {
+		return nil
+	}
+
+	_, steps, err := m.sourcePath()
+	if err != nil {
+		return err
+	}
+
+	raw := false
+	for _, step := range steps {
+		if _, ok := step.(v05Step); ok {
+			raw = true
+		}
+	}
+	if !raw {
+		return nil
+	}
+
+	names := make([]string, 0, len(buckets))
+	for name, kind := range buckets {
+		if kind == TypeBucket {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	return &Error{From: "0.4", To: "0.5", Bucket: names[0], Err: fmt.Errorf("%w by the %s codec, the bucket must be registered with AddBuckets", errRawCodec, m.forceCodec.Name())}
+}
+
+// rawIndex holds the entries of an index, whatever its layout.
+type rawIndex struct {
+	field   string
+	list    bool
+	entries []rawEntry
+}
+
+type rawEntry struct {
+	value, id []byte
+}
+
+// readIndexes reads the unique indexes and the list indexes using one bucket per value,
+// as stored by Storm v0.4 and v0.5.
+func readIndexes(b *bolt.Bucket) ([]rawIndex, error) {
+	var indexes []rawIndex
+
+	c := b.Cursor()
+	for k, v := c.Seek([]byte(indexPrefix)); bytes.HasPrefix(k, []byte(indexPrefix)); k, v = c.Next() {
+		if v != nil {
+			continue
+		}
+
+		idx := rawIndex{field: string(k[len(indexPrefix):])}
+		ib := b.Bucket(k)
+
+		ids := ib.Bucket([]byte(listIDs))
+		if ids != nil {
+			// list index, the ids bucket maps ids to values
+			idx.list = true
+			ib = ids
+		}
+
+		err := ib.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+
+			e := rawEntry{value: k, id: v}
+			if idx.list {
+				e = rawEntry{value: v, id: k}
+			}
+			idx.entries = append(idx.entries, rawEntry{
+				value: append([]byte(nil), e.value...),
+				id:    append([]byte(nil), e.id...),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		indexes = append(indexes, idx)
+	}
+
+	return indexes, nil
+}
+
+// rawV05 migrates a bucket from Storm v0.4 to v0.5: integer ids and indexed values
+// are stored in binary and the bucket gets its own metadata.
+// The records and the index entries are first copied to a staging bucket and the bucket is dropped,
+// then the records are saved back. Both are done in batches, each of them in its own transaction.
+func rawV05(db *bolt.DB, ctx Context, name string) error {
+	var done bool
+	err := db.Update(func(tx *bolt.Tx) error {
+		if rawStage(tx, name) != nil {
+			// interrupted
+			return nil
+		}
+
+		b := tx.Bucket([]byte(name))
+		if b == nil || b.Bucket([]byte(metadataBucket)) != nil {
+			// already migrated
+			done = true
+			return nil
+		}
+
+		return startRawStage(tx, b, name)
+	})
+	if err != nil || done {
+		return err
+	}
+
+	for copied := false; !copied; {
+		err = ctx.Context.Err()
+		if err != nil {
+			return err
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			var err error
+			copied, err = copyRawBatch(tx, name, ctx.Codec, ctx.BatchSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for saved := false; !saved; {
+		err = ctx.Context.Err()
+		if err != nil {
+			return err
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			var err error
+			saved, err = saveRawBatch(tx, name, ctx.Codec, ctx.BatchSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Bucket holding the content of the raw buckets being migrated to v0.5, by bucket name.
+// It is removed once they are saved back.
+const rawStaging = "__storm_raw"
+
+// Content of the staging bucket of a raw bucket
+const (
+	// raw records, by key
+	rawRecords = "records"
+	// indexed fields, with the kind of their index
+	rawFields = "fields"
+	// indexed values, by field then by key of the record
+	rawIndexes = "indexes"
+	// field whose index is being copied, the records are copied first
+	rawField = "field"
+	// last key copied or saved back
+	rawKey = "key"
+	// set once the records and the index entries are copied and the bucket is dropped
+	rawCopied = "copied"
+	// sequence of the bucket
+	rawSequence = "sequence"
+)
+
+// Kinds of index stored in the rawFields bucket
+var (
+	rawUnique = []byte("unique")
+	rawList   = []byte("list")
+)
+
+// rawStage returns the staging bucket of the given raw bucket, or nil if it isn't being migrated.
+func rawStage(tx *bolt.Tx, name string) *bolt.Bucket {
+	staging := tx.Bucket([]byte(rawStaging))
+	if staging == nil {
+		return nil
+	}
+
+	return staging.Bucket([]byte(name))
+}
+
+// startRawStage creates the staging bucket of the given raw bucket and records the kind of its indexes.
+func startRawStage(tx *bolt.Tx, b *bolt.Bucket, name string) error {
+	staging, err := tx.CreateBucketIfNotExists([]byte(rawStaging))
+	if err != nil {
+		return err
+	}
+
+	s, err := staging.CreateBucket([]byte(name))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.CreateBucket([]byte(rawRecords))
+	if err != nil {
+		return err
+	}
+
+	fields, err := s.CreateBucket([]byte(rawFields))
+	if err != nil {
+		return err
+	}
+
+	indexes, err := s.CreateBucket([]byte(rawIndexes))
+	if err != nil {
+		return err
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek([]byte(indexPrefix)); bytes.HasPrefix(k, []byte(indexPrefix)); k, v = c.Next() {
+		if v != nil {
+			continue
+		}
+
+		field := k[len(indexPrefix):]
+		kind := rawUnique
+		if b.Bucket(k).Bucket([]byte(listIDs)) != nil {
+			kind = rawList
+		}
+
+		err = fields.Put(field, kind)
+		if err != nil {
+			return err
+		}
+
+		_, err = indexes.CreateBucket(field)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyRawBatch copies a batch of records, or of entries of an index, of the raw bucket to its staging bucket.
+// Once everything is copied, the bucket is dropped and copyRawBatch returns true.
+func copyRawBatch(tx *bolt.Tx, name string, c codec.MarshalUnmarshaler, size int) (bool, error) {
+	s := rawStage(tx, name)
+	if s.Get([]byte(rawCopied)) != nil {
+		return true, nil
+	}
+
+	b := tx.Bucket([]byte(name))
+	field := s.Get([]byte(rawField))
+
+	src := b
+	put := func(k, v []byte) error {
+		// the records are decoded before the bucket is dropped to fail early
+		var record map[string]interface{}
+		err := c.Unmarshal(v, &record)
+		if err != nil {
+			return &Error{Bucket: name, Key: append([]byte(nil), k...), Err: err}
+		}
+
+		return s.Bucket([]byte(rawRecords)).Put(k, v)
+	}
+
+	if field != nil {
+		values := s.Bucket([]byte(rawIndexes)).Bucket(field)
+		src = b.Bucket(append([]byte(indexPrefix), field...))
+		if bytes.Equal(s.Bucket([]byte(rawFields)).Get(field), rawList) {
+			// the ids bucket maps ids to values
+			src = src.Bucket([]byte(listIDs))
+			put = values.Put
+		} else {
+			put = func(value, id []byte) error {
+				return values.Put(id, value)
+			}
+		}
+	}
+
+	last, err := rawBatch(src, s.Get([]byte(rawKey)), size, put)
+	if err != nil {
+		return false, err
+	}
+
+	if last != nil {
+		return false, s.Put([]byte(rawKey), last)
+	}
+
+	err = deleteRawKey(s)
+	if err != nil {
+		return false, err
+	}
+
+	// copy the next index
+	cursor := s.Bucket([]byte(rawFields)).Cursor()
+	next, _ := cursor.First()
+	if field != nil {
+		next, _ = cursor.Seek(field)
+		if bytes.Equal(next, field) {
+			next, _ = cursor.Next()
+		}
+	}
+
+	if next != nil {
+		return false, s.Put([]byte(rawField), append([]byte(nil), next...))
+	}
+
+	// its sequence is kept so that AutoIncrement doesn't reuse the ids
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, b.Sequence())
+	err = s.Put([]byte(rawSequence), seq)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.DeleteBucket([]byte(name))
+	if err != nil {
+		return false, err
+	}
+
+	return false, s.Put([]byte(rawCopied), []byte{1})
+}
+
+// saveRawBatch saves a batch of records of the staging bucket back to the raw bucket, using the layout of Storm v0.5,
+// and adds them to the indexes. Once every record is saved, the staging bucket is removed and saveRawBatch returns true.
+func saveRawBatch(tx *bolt.Tx, name string, c codec.MarshalUnmarshaler, size int) (bool, error) {
+	s := rawStage(tx, name)
+	fields := s.Bucket([]byte(rawFields))
+	indexes := s.Bucket([]byte(rawIndexes))
+
+	b := tx.Bucket([]byte(name))
+	if b == nil {
+		var err error
+		b, err = createRawV05(tx, name, s, c)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	last, err := rawBatch(s.Bucket([]byte(rawRecords)), s.Get([]byte(rawKey)), size, func(k, v []byte) error {
+		var record map[string]interface{}
+		err := c.Unmarshal(v, &record)
+		if err != nil {
+			return &Error{Bucket: name, Key: append([]byte(nil), k...), Err: err}
+		}
+
+		id := rawID(k, record, c)
+		err = b.Put(id, v)
+		if err != nil {
+			return err
+		}
+
+		return fields.ForEach(func(field, kind []byte) error {
+			value := indexes.Bucket(field).Get(k)
+			if value == nil {
+				return nil
+			}
+
+			add, err := indexV05(b, rawIndex{field: string(field), list: bytes.Equal(kind, rawList)})
+			if err != nil {
+				return err
+			}
+
+			return add(rawValue(value, record[string(field)], c), id)
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if last != nil {
+		return false, s.Put([]byte(rawKey), last)
+	}
+
+	staging := tx.Bucket([]byte(rawStaging))
+	err = staging.DeleteBucket([]byte(name))
+	if err != nil {
+		return false, err
+	}
+
+	// drop the staging bucket once every raw bucket is migrated
+	if k, _ := staging.Cursor().First(); k == nil {
+		err = tx.DeleteBucket([]byte(rawStaging))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// createRawV05 creates the raw bucket with the metadata, the sequence and the indexes of Storm v0.5.
+func createRawV05(tx *bolt.Tx, name string, s *bolt.Bucket, c codec.MarshalUnmarshaler) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucket([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.SetSequence(binary.BigEndian.Uint64(s.Get([]byte(rawSequence))))
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := b.CreateBucket([]byte(metadataBucket))
+	if err != nil {
+		return nil, err
+	}
+
+	err = meta.Put([]byte("codec"), []byte(c.Name()))
+	if err != nil {
+		return nil, err
+	}
+
+	// the indexes are kept even if they are empty
+	err = s.Bucket([]byte(rawFields)).ForEach(func(field, kind []byte) error {
+		_, err := indexV05(b, rawIndex{field: string(field), list: bytes.Equal(kind, rawList)})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// deleteRawKey removes the position of the last batch from the staging bucket.
+func deleteRawKey(s *bolt.Bucket) error {
+	if s.Get([]byte(rawKey)) == nil {
+		return nil
+	}
+
+	return s.Delete([]byte(rawKey))
+}
+
+// rawBatch calls fn with at most size values of the bucket, starting after the given key.
+// It returns the last key processed, or nil if there are no more values.
+func rawBatch(b *bolt.Bucket, after []byte, size int, fn func(k, v []byte) error) ([]byte, error) {
+	cursor := b.Cursor()
+	k, v := cursor.First()
+	if after != nil {
+		k, v = cursor.Seek(after)
+		if bytes.Equal(k, after) {
+			k, v = cursor.Next()
+		}
+	}
+
+	var last []byte
+	for i := 0; k != nil && i < size; k, v = cursor.Next() {
+		if v == nil {
+			continue
+		}
+
+		err := fn(k, v)
+		if err != nil {
+			return nil, err
+		}
+
+		last = k
+		i++
+	}
+
+	if last == nil {
+		return nil, nil
+	}
+
+	return append([]byte(nil), last...), nil
+}
+
+func indexV05(b *bolt.Bucket, idx rawIndex) (func(value, id []byte) error, error) {
+	if idx.list {
+		li, err := indexv05.NewListIndex(b, []byte(indexPrefix+idx.field))
+		if err != nil {
+			return nil, err
+		}
+		return li.Add, nil
+	}
+
+	ui, err := indexv05.NewUniqueIndex(b, []byte(indexPrefix+idx.field))
+	if err != nil {
+		return nil, err
+	}
+	return ui.Add, nil
+}
+
+// rawV06 migrates a bucket from Storm v0.5 to v0.6: list indexes are stored in a single bucket.
+func rawV06(db *bolt.DB, ctx Context, name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+
+		indexes, err := readIndexes(b)
+		if err != nil {
+			return err
+		}
+
+		for _, idx := range indexes {
+			if !idx.list || !nestedList(b.Bucket([]byte(indexPrefix+idx.field))) {
+				continue
+			}
+
+			err = b.DeleteBucket([]byte(indexPrefix + idx.field))
+			if err != nil {
+				return err
+			}
+
+			li, err := indexv06.NewListIndex(b, []byte(indexPrefix+idx.field))
+			if err != nil {
+				return err
+			}
+
+			for _, e := range idx.entries {
+				err = li.Add(e.value, e.id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// nestedList reports whether the list index uses one bucket per value, as done by Storm v0.5.
+// Empty indexes are reported as nested.
+func nestedList(b *bolt.Bucket) bool {
+	nested := true
+	b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			nested = false
+		}
+		return nil
+	})
+	return nested
+}
+
+// rawID returns the id of a record as stored by Storm v0.5.
+// Integer ids are encoded by the codec in v0.4, they are detected using the fields of the record:
+// the key is an integer if the field it matches is a number.
+func rawID(k []byte, record map[string]interface{}, c codec.MarshalUnmarshaler) []byte {
+	n, ok := rawInteger(k, c)
+	if !ok {
+		return k
+	}
+
+	fields := make([]string, 0, len(record))
+	for field := range record {
+		if field != "ID" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	fields = append([]string{"ID"}, fields...)
+
+	for _, field := range fields {
+		switch v := record[field].(type) {
+		case string:
+			if v == string(k) {
+				return k
+			}
+		default:
+			if f, ok := toFloat(v); ok && f == float64(n) {
+				key, _ := numbertob(n)
+				return key
+			}
+		}
+	}
+
+	return k
+}
+
+// rawValue returns an indexed value as stored by Storm v0.5, given the decoded value of the field.
+func rawValue(value []byte, field interface{}, c codec.MarshalUnmarshaler) []byte {
+	n, ok := rawInteger(value, c)
+	if !ok {
+		return value
+	}
+
+	if f, ok := toFloat(field); ok && f == float64(n) {
+		key, _ := numbertob(n)
+		return key
+	}
+
+	return value
+}
+
+// rawInteger decodes an integer encoded with the codec.
+func rawInteger(k []byte, c codec.MarshalUnmarshaler) (int64, bool) {
+	var n int64
+	if c.Unmarshal(k, &n) != nil {
+		return 0, false
+	}
+
+	// make sure the key is exactly the encoded integer
+	raw, err := c.Marshal(n)
+	if err != nil || !bytes.Equal(raw, k) {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+
+	r := reflect.ValueOf(v)
+	switch {
+	case r.Kind() >= reflect.Int && r.Kind() <= reflect.Int64:
+		return float64(r.Int()), true
+	case r.Kind() >= reflect.Uint && r.Kind() <= reflect.Uint64:
+		return float64(r.Uint()), true
+	case r.Kind() == reflect.Float32 || r.Kind() == reflect.Float64:
+		return r.Float(), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,155 @@
+package migrator_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	gobv04 "github.com/asdine/storm-migrator/v0.4/codec/gob"
+	"github.com/asdine/storm-migrator/v0.5/codec/gob"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/stretchr/testify/require"
+)
+
+type Untyped struct {
+	ID    int
+	Name  string `storm:"index"`
+	Email string `storm:"unique"`
+	Age   int    `storm:"index"`
+}
+
+type StringID struct {
+	ID   string
+	Code int `storm:"unique"`
+}
+
+func TestRaw(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		err = dbv04.Save(&Untyped{ID: i + 1, Name: fmt.Sprintf("name%d", i%3), Email: fmt.Sprintf("%d@example.com", i), Age: 20 + i%2})
+		require.NoError(t, err)
+		err = dbv04.Save(&StringID{ID: fmt.Sprint(i + 100), Code: i + 100})
+		require.NoError(t, err)
+	}
+	dbv04.Close()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.Raw())
+	require.NoError(t, err)
+
+	// the raw buckets can be verified using their types
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B), new(Untyped), new(StringID))
+	r, err := m.Verify(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	require.True(t, r.OK(), r.String())
+
+	db, err := stormv06.Open(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var u Untyped
+	err = db.One("ID", 3, &u)
+	require.NoError(t, err)
+	require.Equal(t, "2@example.com", u.Email)
+
+	err = db.One("Email", "5@example.com", &u)
+	require.NoError(t, err)
+	require.Equal(t, 6, u.ID)
+
+	var list []Untyped
+	err = db.Find("Name", "name1", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+
+	err = db.Find("Age", 21, &list)
+	require.NoError(t, err)
+	require.Len(t, list, 5)
+
+	var s StringID
+	err = db.One("ID", "105", &s)
+	require.NoError(t, err)
+	err = db.One("Code", 107, &s)
+	require.NoError(t, err)
+	require.Equal(t, "107", s.ID)
+
+	err = db.Save(&Untyped{ID: 11, Name: "name0"})
+	require.NoError(t, err)
+	err = db.Find("Name", "name0", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 5)
+}
+
+func TestRawBatches(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		err = dbv04.Save(&Untyped{ID: i + 1, Name: fmt.Sprintf("name%d", i%3), Email: fmt.Sprintf("%d@example.com", i), Age: 20 + i%2})
+		require.NoError(t, err)
+	}
+	dbv04.Close()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.Raw(), migrator.BatchSize(3))
+	require.NoError(t, err)
+
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B), new(Untyped))
+	r, err := m.Verify(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	require.True(t, r.OK(), r.String())
+
+	db, err := stormv06.Open(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var list []Untyped
+	err = db.Find("Name", "name0", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 4)
+
+	var u Untyped
+	err = db.One("Email", "9@example.com", &u)
+	require.NoError(t, err)
+	require.Equal(t, 10, u.ID)
+}
+
+func TestRawUnsupportedCodec(t *testing.T) {
+	dir, _, cleanup := prepareDB(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "gob.db")
+	dbv04, err := stormv04.Open(path, stormv04.Codec(gobv04.Codec))
+	require.NoError(t, err)
+	err = dbv04.Save(&Untyped{ID: 1, Name: "name", Email: "1@example.com"})
+	require.NoError(t, err)
+	dbv04.Close()
+
+	m := migrator.New(path)
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.Raw(), migrator.Codec(gob.Codec))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the records can't be decoded without their type by the gob codec")
+
+	var merr *migrator.Error
+	require.True(t, errors.As(err, &merr))
+	require.Equal(t, "Untyped", merr.Bucket)
+
+	// nothing was written
+	_, err = os.Stat(filepath.Join(dir, "v06.db"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,127 @@
+package migrator
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// rename of a top level bucket
+type rename struct {
+	from, to string
+}
+
+// RenameBucket renames a top level bucket before migrating it. The bucket is registered under its new name,
+// with AddBuckets or AddKV, and the registered types decode the records of the old bucket.
+// Buckets of a type renamed since they were created should rather be registered with AddBucketAs.
+func (m *Migrator) RenameBucket(oldName, newName string) {
+	m.renames = append(m.renames, rename{from: oldName, to: newName})
+}
+
+// AddBucketAs registers the bucket of a type that was renamed, like AddBuckets. The records of the old bucket
+// are decoded using the new type, saved in the bucket named after it and indexed using its tags.
+// The old bucket is removed.
+func (m *Migrator) AddBucketAs(oldName string, newInstance interface{}) {
+	m.RenameBucket(oldName, bucketName(newInstance))
+	m.renamedTypes = append(m.renamedTypes, newInstance)
+	m.AddBuckets(newInstance)
+}
+
+// sourceName returns the name of the bucket in the source database.
+func (m *Migrator) sourceName(bucketName string) string {
+	for i := len(m.renames) - 1; i >= 0; i-- {
+		if m.renames[i].to == bucketName {
+			bucketName = m.renames[i].from
+		}
+	}
+
+	return bucketName
+}
+
+// renameBuckets renames the registered buckets in a single transaction.
+// Buckets that don't exist, or were already renamed, are skipped.
+func (m *Migrator) renameBuckets(b *bolt.DB) error {
+	if len(m.renames) == 0 {
+		return nil
+	}
+
+	return b.Update(func(tx *bolt.Tx) error {
+		for _, r := range m.renames {
+			err := renameBucket(tx, r.from, r.to)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// renameBucket copies a bucket and all its content under another name and deletes it.
+func renameBucket(tx *bolt.Tx, from, to string) error {
+	src := tx.Bucket([]byte(from))
+	if src == nil {
+		return nil
+	}
+
+	if tx.Bucket([]byte(to)) != nil {
+		return fmt.Errorf("can't rename bucket %s, bucket %s already exists", from, to)
+	}
+
+	dst, err := tx.CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+
+	err = dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+
+	err = walkBucket(src, nil, func(path [][]byte, k, v []byte, seq uint64) error {
+		b := dst
+		for _, name := range path {
+			b = b.Bucket(name)
+		}
+
+		if v != nil {
+			return b.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+		}
+
+		nb, err := b.CreateBucket(append([]byte(nil), k...))
+		if err != nil {
+			return err
+		}
+		return nb.SetSequence(seq)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.DeleteBucket([]byte(from))
+}
+
+// resaveRenamed saves the records of the buckets registered with AddBucketAs again,
+// so that they are indexed using the tags of the new types whatever the steps did.
+func (m *Migrator) resaveRenamed(b *bolt.DB) error {
+	if len(m.renamedTypes) == 0 {
+		return nil
+	}
+
+	version, err := m.getVersion(b)
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range m.renamedTypes {
+		c := m.codecOf(bucketName(inst))
+		err = b.Update(func(tx *bolt.Tx) error {
+			return m.resaveType(tx, version, inst, c, c)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
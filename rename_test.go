@@ -0,0 +1,101 @@
+package migrator_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+type UserV1 struct {
+	ID    int
+	Name  string `storm:"index"`
+	Email string
+}
+
+type User struct {
+	ID    int
+	Name  string `storm:"index"`
+	Email string `storm:"unique"`
+}
+
+func TestAddBucketAs(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = dbv04.Save(&UserV1{ID: i + 1, Name: fmt.Sprintf("name%d", i%2), Email: fmt.Sprintf("%d@example.com", i)})
+		require.NoError(t, err)
+	}
+	err = dbv04.Set("old-settings", "key", "value")
+	require.NoError(t, err)
+	dbv04.Close()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddBucketAs("UserV1", new(User))
+	m.RenameBucket("old-settings", "settings")
+	m.AddKV("settings", []interface{}{new(string)})
+
+	r, err := m.Plan()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bucket"}, r.Unregistered)
+
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.Verify())
+	require.NoError(t, err)
+
+	db, err := stormv06.Open(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+
+	var list []User
+	err = db.Find("Name", "name0", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+
+	// the new unique index is built
+	var u User
+	err = db.One("Email", "3@example.com", &u)
+	require.NoError(t, err)
+	require.Equal(t, 4, u.ID)
+
+	var v string
+	err = db.Get("settings", "key", &v)
+	require.NoError(t, err)
+	require.Equal(t, "value", v)
+
+	err = db.Bolt.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte("UserV1")))
+		require.Nil(t, tx.Bucket([]byte("old-settings")))
+		return nil
+	})
+	require.NoError(t, err)
+	db.Close()
+
+	// already at the latest version, the records are indexed again
+	m = migrator.New(filepath.Join(dir, "v06.db"))
+	m.AddBucketAs("User", new(UserV1))
+	err = m.Run(filepath.Join(dir, "other.db"), migrator.Verify())
+	require.NoError(t, err)
+
+	db, err = stormv06.Open(filepath.Join(dir, "other.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var old UserV1
+	err = db.One("ID", 2, &old)
+	require.NoError(t, err)
+	err = db.Bolt.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("UserV1"))
+		require.NotNil(t, bucket.Bucket([]byte("__storm_index_Name")))
+		require.Nil(t, bucket.Bucket([]byte("__storm_index_Email")))
+		return nil
+	})
+	require.NoError(t, err)
+}
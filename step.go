@@ -0,0 +1,469 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	stormv05 "github.com/asdine/storm-migrator/v0.5"
+	"github.com/asdine/storm-migrator/v0.5/codec"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+)
+
+// A Step migrates a database from one version to another.
+// Versions are matched by prefix: a step from "0.5" handles databases at version "0.5.0".
+type Step interface {
+	// FromVersion returns the version of the databases this step can migrate
+	FromVersion() string
+	// ToVersion returns the version of the database once the step is done
+	ToVersion() string
+	// Run the step on the given database
+	Run(db *bolt.DB, ctx Context) error
+}
+
+// Context contains everything registered on the Migrator that a Step might need.
+type Context struct {
+	// Codec used to decode and encode records and keys
+	Codec codec.MarshalUnmarshaler
+	// Codecs of the buckets that don't use Codec, by bucket name
+	Codecs map[string]codec.MarshalUnmarshaler
+	// Instances registered with AddBuckets
+	Instances []interface{}
+	// Nodes registered with AddBucketsAt and AddKVAt, with their wildcards expanded
+	Nodes []Node
+	// Key instances registered with AddKV, by bucket name
+	KV map[string][]interface{}
+	// Key functions registered with AddKVFunc, by bucket name
+	KVFuncs map[string]func([]byte) (interface{}, error)
+	// Functions registered with Transform, by bucket name. They are only given to the first step
+	// of the migration, which must apply them to the records
+	Transforms map[string]func(reflect.Value) (interface{}, error)
+	// Emit sends an event to the function registered with OnEvent, if any
+	Emit func(Event)
+	// Raw is true if the unregistered buckets must be migrated without their type
+	Raw bool
+	// Number of records saved in a single transaction, 0 if not set
+	BatchSize int
+	// AutoIncrement is true if the database is opened with the AutoIncrement option of Storm
+	AutoIncrement bool
+	// Context given to RunContext. Steps should check it between records and return its error once it is done
+	Context context.Context
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		up:   make(graph),
+		down: make(graph),
+	}
+}
+
+// DefaultRegistry returns a Registry containing the steps shipped with the migrator.
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register(v05Step{})
+	r.Register(v06Step{})
+	r.RegisterDowngrade(v05DowngradeStep{})
+	r.RegisterDowngrade(v04DowngradeStep{})
+	return r
+}
+
+// Registry holds the available steps and builds the migration path between two versions.
+// Upgrade and downgrade steps are kept apart, each of them must not form a cycle.
+type Registry struct {
+	up   graph
+	down graph
+}
+
+// Register an upgrade step. Registering a step between two versions that already have one
+// or a step that would allow to come back to a previous version fails.
+func (r *Registry) Register(s Step) error {
+	return r.up.register(s)
+}
+
+// RegisterDowngrade registers a step that migrates a database back to an older version.
+func (r *Registry) RegisterDowngrade(s Step) error {
+	return r.down.register(s)
+}
+
+// Path returns the shortest list of steps needed to migrate a database from one version to the other.
+// If to is empty, the path leads to the latest version reachable from the given version.
+// If to is older than from, the path is made of downgrade steps.
+func (r *Registry) Path(from, to string) ([]Step, error) {
+	src, ok := r.resolve(from)
+	if !ok {
+		return nil, r.unknownVersion(from)
+	}
+
+	if to == "" {
+		var err error
+		to, err = r.up.latest(src)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dst, ok := r.resolve(to)
+	if !ok {
+		return nil, r.unknownVersion(to)
+	}
+
+	if src == dst {
+		return nil, nil
+	}
+
+	if compareVersions(src, dst) > 0 {
+		path := r.down.path(src, dst)
+		if path == nil {
+			return nil, fmt.Errorf("%w: %s is newer than %s", ErrNewerThanTarget, from, to)
+		}
+		return path, nil
+	}
+
+	path := r.up.path(src, dst)
+	if path == nil {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrNoPath, from, to)
+	}
+
+	return path, nil
+}
+
+// resolve returns the most specific registered version matching v.
+func (r *Registry) resolve(v string) (string, bool) {
+	var found string
+	for _, version := range append(r.up.versions(), r.down.versions()...) {
+		if matchVersion(version, v) && len(version) > len(found) {
+			found = version
+		}
+	}
+
+	return found, found != ""
+}
+
+// unknownVersion returns the error describing why no registered step handles the version v:
+// it is either older or newer than all of them, or in between.
+func (r *Registry) unknownVersion(v string) error {
+	versions := append(r.up.versions(), r.down.versions()...)
+	if len(versions) == 0 || v == "" || v[0] < '0' || v[0] > '9' {
+		return fmt.Errorf("%w: %s", ErrUnknownVersion, v)
+	}
+
+	older, newer := true, true
+	for _, version := range versions {
+		c := compareVersions(v, version)
+		if c >= 0 {
+			older = false
+		}
+		if c <= 0 {
+			newer = false
+		}
+	}
+
+	switch {
+	case older:
+		return &versionError{err: ErrUnsupportedVersion, version: v}
+	case newer:
+		return &versionError{err: ErrNewerThanSupported, version: v}
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnknownVersion, v)
+}
+
+// graph of steps, indexed by the version they migrate from.
+type graph map[string][]Step
+
+func (g graph) register(s Step) error {
+	from, to := s.FromVersion(), s.ToVersion()
+	if from == to {
+		return fmt.Errorf("%w: %s -> %s", ErrCycle, from, to)
+	}
+
+	for _, step := range g[from] {
+		if step.ToVersion() == to {
+			return fmt.Errorf("%w: %s -> %s", ErrDuplicateStep, from, to)
+		}
+	}
+
+	if g.path(to, from) != nil {
+		return fmt.Errorf("%w: %s -> %s", ErrCycle, from, to)
+	}
+
+	g[from] = append(g[from], s)
+	return nil
+}
+
+// latest returns the only version reachable from the given one that has no outgoing step.
+func (g graph) latest(from string) (string, error) {
+	seen := map[string]bool{from: true}
+	queue := []string{from}
+	var tips []string
+
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+
+		if len(g[v]) == 0 {
+			tips = append(tips, v)
+			continue
+		}
+
+		for _, s := range g[v] {
+			if !seen[s.ToVersion()] {
+				seen[s.ToVersion()] = true
+				queue = append(queue, s.ToVersion())
+			}
+		}
+	}
+
+	if len(tips) != 1 {
+		sort.Strings(tips)
+		return "", fmt.Errorf("%w: several latest versions reachable from %s: %s", ErrNoPath, from, strings.Join(tips, ", "))
+	}
+
+	return tips[0], nil
+}
+
+// path does a breadth first search and returns the shortest path between two versions.
+func (g graph) path(from, to string) []Step {
+	prev := make(map[string]Step)
+	seen := map[string]bool{from: true}
+	queue := []string{from}
+
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+
+		if v == to {
+			var path []Step
+			for v != from {
+				s := prev[v]
+				path = append([]Step{s}, path...)
+				v = s.FromVersion()
+			}
+			return path
+		}
+
+		for _, s := range g[v] {
+			if !seen[s.ToVersion()] {
+				seen[s.ToVersion()] = true
+				prev[s.ToVersion()] = s
+				queue = append(queue, s.ToVersion())
+			}
+		}
+	}
+
+	return nil
+}
+
+func (g graph) versions() []string {
+	var list []string
+	seen := make(map[string]bool)
+	for from, steps := range g {
+		if !seen[from] {
+			seen[from] = true
+			list = append(list, from)
+		}
+		for _, s := range steps {
+			if !seen[s.ToVersion()] {
+				seen[s.ToVersion()] = true
+				list = append(list, s.ToVersion())
+			}
+		}
+	}
+
+	return list
+}
+
+// isDowngrade reports whether the step migrates a database to an older version.
+func isDowngrade(s Step) bool {
+	return compareVersions(s.FromVersion(), s.ToVersion()) > 0
+}
+
+// matchVersion reports whether the version v is handled by the step version.
+func matchVersion(version, v string) bool {
+	return v == version || strings.HasPrefix(v, version+".")
+}
+
+// compareVersions compares two versions component by component.
+// The numeric prefix of each component is compared first, then the rest of it.
+// It returns -1, 0 or 1 if a is older, the same or newer than b.
+func compareVersions(a, b string) int {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, ra := splitNumber(pa[i])
+		nb, rb := splitNumber(pb[i])
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		case ra < rb:
+			return -1
+		case ra > rb:
+			return 1
+		}
+	}
+
+	switch {
+	case len(pa) < len(pb):
+		return -1
+	case len(pa) > len(pb):
+		return 1
+	}
+	return 0
+}
+
+func splitNumber(s string) (int, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n, s[i:]
+}
+
+// v05Step migrates databases from Storm v0.4 to v0.5.
+type v05Step struct{}
+
+func (v05Step) FromVersion() string { return "0.4" }
+func (v05Step) ToVersion() string   { return "0.5" }
+
+func (s v05Step) Run(db *bolt.DB, ctx Context) error {
+	if ctx.Raw {
+		err := migrateRaw(db, ctx, rawV05)
+		if err != nil {
+			return err
+		}
+	}
+
+	options := []func(*stormv05.Migrator){
+		stormv05.Observe(stepObserver{step: s, emit: ctx.Emit}),
+		stormv05.BatchSize(ctx.BatchSize),
+		stormv05.Context(ctx.Context),
+	}
+	for name, fn := range ctx.KVFuncs {
+		options = append(options, stormv05.KeyFunc(name, fn))
+	}
+	for name, c := range ctx.Codecs {
+		options = append(options, stormv05.BucketCodec(name, c))
+	}
+	for name, fn := range ctx.Transforms {
+		options = append(options, stormv05.Transform(name, fn))
+	}
+
+	mig := stormv05.NewMigrator(db, ctx.Codec, options...)
+	for _, n := range ctx.Nodes {
+		err := mig.RunAt(n.Path, n.Instances, n.KV)
+		if err != nil {
+			return err
+		}
+	}
+
+	return mig.Run(ctx.Instances, ctx.KV)
+}
+
+// v06Step migrates databases from Storm v0.5 to v0.6.
+type v06Step struct{}
+
+func (v06Step) FromVersion() string { return "0.5" }
+func (v06Step) ToVersion() string   { return "0.6" }
+
+func (s v06Step) Run(db *bolt.DB, ctx Context) error {
+	if ctx.Raw {
+		err := migrateRaw(db, ctx, rawV06)
+		if err != nil {
+			return err
+		}
+	}
+
+	options := []func(*stormv06.Migrator){
+		stormv06.Observe(stepObserver{step: s, emit: ctx.Emit}),
+		stormv06.Context(ctx.Context),
+	}
+	for name, c := range ctx.Codecs {
+		options = append(options, stormv06.BucketCodec(name, c))
+	}
+	if ctx.AutoIncrement {
+		options = append(options, stormv06.MigratorAutoIncrement())
+	}
+	for name, fn := range ctx.Transforms {
+		options = append(options, stormv06.Transform(name, fn))
+	}
+
+	mig := stormv06.NewMigrator(db, ctx.Codec, options...)
+	for _, n := range ctx.Nodes {
+		err := mig.RunAt(n.Path, n.Instances, n.KV)
+		if err != nil {
+			return err
+		}
+	}
+
+	return mig.Run(ctx.Instances, ctx.KV)
+}
+
+// v05DowngradeStep migrates databases from Storm v0.6 back to v0.5.
+type v05DowngradeStep struct{}
+
+func (v05DowngradeStep) FromVersion() string { return "0.6" }
+func (v05DowngradeStep) ToVersion() string   { return "0.5" }
+
+func (v05DowngradeStep) Run(db *bolt.DB, ctx Context) error {
+	if len(ctx.Nodes) > 0 {
+		return errNestedDowngrade
+	}
+
+	if len(ctx.Transforms) > 0 {
+		return errTransformDowngrade
+	}
+
+	var options []func(*stormv05.Downgrader)
+	for name, c := range ctx.Codecs {
+		options = append(options, stormv05.DowngraderBucketCodec(name, c))
+	}
+
+	return stormv05.NewDowngrader(db, ctx.Codec, options...).Run(ctx.Instances, ctx.KV)
+}
+
+// v04DowngradeStep migrates databases from Storm v0.5 back to v0.4.
+type v04DowngradeStep struct{}
+
+func (v04DowngradeStep) FromVersion() string { return "0.5" }
+func (v04DowngradeStep) ToVersion() string   { return "0.4" }
+
+func (v04DowngradeStep) Run(db *bolt.DB, ctx Context) error {
+	if len(ctx.Nodes) > 0 {
+		return errNestedDowngrade
+	}
+
+	if len(ctx.Transforms) > 0 {
+		return errTransformDowngrade
+	}
+
+	options := []func(*stormv04.Downgrader){stormv04.DowngraderBatchSize(ctx.BatchSize)}
+	for name, c := range ctx.Codecs {
+		options = append(options, stormv04.DowngraderBucketCodec(name, encodeDecoder{c}))
+	}
+
+	return stormv04.NewDowngrader(db, encodeDecoder{ctx.Codec}, options...).Run(ctx.Instances, ctx.KV)
+}
+
+var errNestedDowngrade = errors.New("buckets registered with AddBucketsAt or AddKVAt can't be downgraded")
+
+// encodeDecoder adapts a codec to the interface used by Storm v0.4.
+type encodeDecoder struct {
+	codec codec.MarshalUnmarshaler
+}
+
+func (e encodeDecoder) Encode(v interface{}) ([]byte, error) {
+	return e.codec.Marshal(v)
+}
+
+func (e encodeDecoder) Decode(b []byte, v interface{}) error {
+	return e.codec.Unmarshal(b, v)
+}
@@ -0,0 +1,149 @@
+package migrator_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+type testStep struct {
+	from, to string
+	run      func(*bolt.DB, migrator.Context) error
+}
+
+func (s *testStep) FromVersion() string { return s.from }
+func (s *testStep) ToVersion() string   { return s.to }
+
+func (s *testStep) Run(db *bolt.DB, ctx migrator.Context) error {
+	if s.run != nil {
+		return s.run(db, ctx)
+	}
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	r := migrator.NewRegistry()
+	require.NoError(t, r.Register(&testStep{from: "1", to: "2"}))
+	require.NoError(t, r.Register(&testStep{from: "2", to: "3"}))
+	require.NoError(t, r.Register(&testStep{from: "1", to: "3"}))
+
+	err := r.Register(&testStep{from: "1", to: "2"})
+	require.True(t, errors.Is(err, migrator.ErrDuplicateStep))
+
+	err = r.Register(&testStep{from: "3", to: "1"})
+	require.True(t, errors.Is(err, migrator.ErrCycle))
+
+	err = r.Register(&testStep{from: "2", to: "2"})
+	require.True(t, errors.Is(err, migrator.ErrCycle))
+
+	steps, err := r.Path("1.0.1", "")
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	require.Equal(t, "1", steps[0].FromVersion())
+	require.Equal(t, "3", steps[0].ToVersion())
+
+	steps, err = r.Path("3", "")
+	require.NoError(t, err)
+	require.Empty(t, steps)
+
+	_, err = r.Path("4", "")
+	require.True(t, errors.Is(err, migrator.ErrUnknownVersion))
+
+	_, err = r.Path("1", "4")
+	require.True(t, errors.Is(err, migrator.ErrUnknownVersion))
+
+	_, err = r.Path("3", "1")
+	require.True(t, errors.Is(err, migrator.ErrNewerThanTarget))
+
+	require.NoError(t, r.Register(&testStep{from: "2", to: "2.1"}))
+	_, err = r.Path("1", "")
+	require.True(t, errors.Is(err, migrator.ErrNoPath))
+
+	steps, err = r.Path("1", "2.1")
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	r := migrator.DefaultRegistry()
+
+	steps, err := r.Path("0.4.1", "")
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+	require.Equal(t, "0.4", steps[0].FromVersion())
+	require.Equal(t, "0.6", steps[1].ToVersion())
+
+	steps, err = r.Path("0.5.0", "")
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+
+	steps, err = r.Path("0.6.0", "")
+	require.NoError(t, err)
+	require.Empty(t, steps)
+
+	_, err = r.Path("0.7.0", "")
+	require.True(t, errors.Is(err, migrator.ErrUnknownVersion))
+	require.True(t, errors.Is(err, migrator.ErrNewerThanSupported))
+
+	_, err = r.Path("0.3.1", "")
+	require.True(t, errors.Is(err, migrator.ErrUnknownVersion))
+	require.True(t, errors.Is(err, migrator.ErrUnsupportedVersion))
+
+	_, err = r.Path("dev", "")
+	require.True(t, errors.Is(err, migrator.ErrUnknownVersion))
+	require.False(t, errors.Is(err, migrator.ErrUnsupportedVersion))
+	require.False(t, errors.Is(err, migrator.ErrNewerThanSupported))
+}
+
+func TestCustomStep(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	var called int
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err := m.RegisterStep(&testStep{
+		from: "0.6",
+		to:   "0.6.0-app.1",
+		run: func(b *bolt.DB, ctx migrator.Context) error {
+			called++
+			require.Len(t, ctx.Instances, 2)
+
+			db, err := stormv06.Open("", stormv06.UseDB(b))
+			require.NoError(t, err)
+			return db.Set("app", "migrated", true)
+		},
+	})
+	require.NoError(t, err)
+
+	err = m.RegisterStep(&testStep{from: "0.6.0-app.1", to: "0.5"})
+	require.True(t, errors.Is(err, migrator.ErrCycle))
+
+	err = m.Run(filepath.Join(dir, "app.db"))
+	require.NoError(t, err)
+	require.Equal(t, 1, called)
+
+	db, err := stormv06.Open(filepath.Join(dir, "app.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var version string
+	err = db.Get("__storm_db", "version", &version)
+	require.NoError(t, err)
+	require.Equal(t, "0.6.0-app.1", version)
+
+	var migrated bool
+	err = db.Get("app", "migrated", &migrated)
+	require.NoError(t, err)
+	require.True(t, migrated)
+
+	var a A
+	err = db.One("ID", 1, &a)
+	require.NoError(t, err)
+}
@@ -0,0 +1,148 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	stormv05 "github.com/asdine/storm-migrator/v0.5"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errTransformDowngrade = errors.New("transforms can't be applied when downgrading")
+	errTransformType      = errors.New("the transform returned a record of a type not registered with AddBuckets")
+)
+
+// Transform registers a function called with every record of the bucket of the given type, between the moment
+// it is decoded and the moment it is saved back. The function receives the decoded record and returns the record
+// to save, which can be of another type and is then saved in the bucket of that type, a slice to split
+// the record in several ones, or nil to drop it. The type is registered as with AddBuckets if it wasn't already.
+// The types of the returned records must be registered as well, so that their buckets are migrated by the next steps.
+// Errors returned by the function stop the migration and are wrapped with the bucket and the id of the record.
+//
+// The functions are applied once, by the first step of the migration. If the database is already at the target
+// version, the records are saved again to apply them.
+func (m *Migrator) Transform(instance interface{}, fn func(old reflect.Value) (interface{}, error)) {
+	name := bucketName(instance)
+
+	var registered bool
+	for _, inst := range m.instances {
+		if bucketName(inst) == name {
+			registered = true
+		}
+	}
+	if !registered {
+		m.AddBuckets(instance)
+	}
+
+	m.transforms[name] = func(old reflect.Value) (interface{}, error) {
+		v, err := fn(old)
+		if err != nil {
+			return nil, err
+		}
+
+		return v, m.checkTransformed(v)
+	}
+}
+
+// checkTransformed makes sure the records returned by a transform function are of registered types.
+func (m *Migrator) checkTransformed(v interface{}) error {
+	for _, record := range transformedRecords(v) {
+		name := bucketName(record)
+
+		var registered bool
+		for _, inst := range m.instances {
+			if bucketName(inst) == name {
+				registered = true
+			}
+		}
+		if !registered {
+			return fmt.Errorf("%w: %s", errTransformType, name)
+		}
+	}
+
+	return nil
+}
+
+// transformInstances returns the registered instances that have a transform function.
+func (m *Migrator) transformInstances() []interface{} {
+	var list []interface{}
+	for _, inst := range m.instances {
+		if _, ok := m.transforms[bucketName(inst)]; ok {
+			list = append(list, inst)
+		}
+	}
+
+	return list
+}
+
+// transformedRecords turns the value returned by a transform function into a list of records,
+// the way the migrators of Storm do.
+func transformedRecords(v interface{}) []interface{} {
+	if v == nil {
+		return nil
+	}
+
+	ref := reflect.ValueOf(v)
+	switch ref.Kind() {
+	case reflect.Slice, reflect.Array:
+		var list []interface{}
+		for i := 0; i < ref.Len(); i++ {
+			list = append(list, transformedRecords(ref.Index(i).Interface())...)
+		}
+		return list
+	case reflect.Ptr:
+		if ref.IsNil() {
+			return nil
+		}
+	}
+
+	return []interface{}{v}
+}
+
+// applyTransforms applies the transform functions to a database that has no step to run,
+// using the migrator of its version. The version of the database is kept as it is.
+func (m *Migrator) applyTransforms(b *bolt.DB) error {
+	if len(m.transforms) == 0 {
+		return nil
+	}
+
+	version, err := m.getVersion(b)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case compareVersions(version, "0.6") >= 0:
+		var options []func(*stormv06.Migrator)
+		for name, fn := range m.transforms {
+			options = append(options, stormv06.Transform(name, fn))
+		}
+		for name, c := range m.codecs {
+			options = append(options, stormv06.BucketCodec(name, c))
+		}
+		if m.autoIncrement {
+			options = append(options, stormv06.MigratorAutoIncrement())
+		}
+		err = stormv06.NewMigrator(b, m.forceCodec, options...).Run(m.transformInstances(), nil)
+	case compareVersions(version, "0.5") >= 0:
+		var options []func(*stormv05.Migrator)
+		for name, fn := range m.transforms {
+			options = append(options, stormv05.Transform(name, fn))
+		}
+		for name, c := range m.codecs {
+			options = append(options, stormv05.BucketCodec(name, c))
+		}
+		err = stormv05.NewMigrator(b, m.forceCodec, options...).Run(m.transformInstances(), nil)
+	default:
+		return fmt.Errorf("%w: transforms can't be applied to a database at version %s without running a step", ErrUnsupportedVersion, version)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the migrators set the version they create, like 0.6.0
+	return m.ensureVersion(b, version)
+}
@@ -0,0 +1,181 @@
+package migrator_test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransform(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.Transform(new(A), func(old reflect.Value) (interface{}, error) {
+		a := old.Addr().Interface().(*A)
+		switch {
+		case a.ID%5 == 0:
+			return nil, nil
+		case a.ID == 2:
+			return []interface{}{a, &B{ID: "split", Field1: 2}}, nil
+		}
+
+		a.Field1 = strings.ToUpper(a.Field1)
+		return *a, nil
+	})
+	err := m.Run(filepath.Join(dir, "v06.db"), migrator.Verify())
+	require.NoError(t, err)
+
+	db, err := stormv06.Open(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+
+	var list []A
+	err = db.All(&list)
+	require.NoError(t, err)
+	require.Len(t, list, 8)
+
+	var a A
+	err = db.One("ID", 3, &a)
+	require.NoError(t, err)
+	require.Equal(t, "FIELD2", a.Field1)
+	err = db.One("ID", 2, &a)
+	require.NoError(t, err)
+	require.Equal(t, "Field1", a.Field1)
+	err = db.One("ID", 5, &a)
+	require.Equal(t, stormv06.ErrNotFound, err)
+
+	var b B
+	err = db.One("ID", "split", &b)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), b.Field1)
+	db.Close()
+
+	// the database is already migrated, the records are saved again
+	m = migrator.New(filepath.Join(dir, "v06.db"))
+	m.Transform(new(B), func(old reflect.Value) (interface{}, error) {
+		old.FieldByName("Field1").SetInt(old.FieldByName("Field1").Int() + 1)
+		return old.Interface(), nil
+	})
+	err = m.Run(filepath.Join(dir, "again.db"), migrator.Verify())
+	require.NoError(t, err)
+
+	db, err = stormv06.Open(filepath.Join(dir, "again.db"))
+	require.NoError(t, err)
+	err = db.One("ID", "split", &b)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), b.Field1)
+	db.Close()
+
+	errBoom := errors.New("boom")
+	m = migrator.New(path)
+	m.Transform(new(A), func(old reflect.Value) (interface{}, error) {
+		if old.FieldByName("ID").Int() == 4 {
+			return nil, errBoom
+		}
+		return old.Interface(), nil
+	})
+	err = m.Run(filepath.Join(dir, "failed.db"))
+	require.True(t, errors.Is(err, errBoom))
+	require.Contains(t, err.Error(), "record 4: boom")
+
+	var merr *migrator.Error
+	require.True(t, errors.As(err, &merr))
+	require.Equal(t, "A", merr.Bucket)
+	require.Equal(t, []byte("4"), merr.Key)
+
+	// the records of unregistered types would not be migrated by the next steps
+	type C struct {
+		ID int
+	}
+	m = migrator.New(path)
+	m.Transform(new(A), func(old reflect.Value) (interface{}, error) {
+		return &C{ID: int(old.FieldByName("ID").Int())}, nil
+	})
+	err = m.Run(filepath.Join(dir, "unregistered.db"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "record 1: the transform returned a record of a type not registered with AddBuckets: C")
+	require.True(t, errors.As(err, &merr))
+	require.Equal(t, "A", merr.Bucket)
+}
+
+func TestRunInPlaceTransform(t *testing.T) {
+	_, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.Transform(new(A), func(old reflect.Value) (interface{}, error) {
+		if old.FieldByName("ID").Int() > 5 {
+			return nil, nil
+		}
+		old.FieldByName("Field1").SetString(strings.ToUpper(old.FieldByName("Field1").String()))
+		return old.Interface(), nil
+	})
+	err := m.RunInPlace()
+	require.NoError(t, err)
+
+	db, err := stormv06.Open(path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var list []A
+	err = db.All(&list)
+	require.NoError(t, err)
+	require.Len(t, list, 5)
+	require.Equal(t, "FIELD0", list[0].Field1)
+}
+
+func TestTransformWithoutSteps(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	transform := func(old reflect.Value) (interface{}, error) {
+		old.FieldByName("Field1").SetString(strings.ToUpper(old.FieldByName("Field1").String()))
+		return old.Interface(), nil
+	}
+
+	// Storm v0.4 has no migrator to save the records again
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.Transform(new(A), transform)
+	err := m.Run(filepath.Join(dir, "v04.db.new"), migrator.TargetVersion("0.4"))
+	require.True(t, errors.Is(err, migrator.ErrUnsupportedVersion))
+	require.Contains(t, err.Error(), "version 0.4.1")
+
+	// custom versions are kept
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.RegisterStep(&testStep{from: "0.6", to: "0.6.0-app.1"})
+	require.NoError(t, err)
+	err = m.Run(filepath.Join(dir, "app.db"))
+	require.NoError(t, err)
+
+	m = migrator.New(filepath.Join(dir, "app.db"))
+	m.AddBuckets(new(A), new(B))
+	err = m.RegisterStep(&testStep{from: "0.6", to: "0.6.0-app.1"})
+	require.NoError(t, err)
+	m.Transform(new(A), transform)
+	err = m.Run(filepath.Join(dir, "transformed.db"), migrator.Verify())
+	require.NoError(t, err)
+
+	r, err := migrator.New(filepath.Join(dir, "transformed.db")).Inspect()
+	require.NoError(t, err)
+	require.Equal(t, "0.6.0-app.1", r.Version)
+
+	db, err := stormv06.Open(filepath.Join(dir, "transformed.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var a A
+	err = db.One("ID", 1, &a)
+	require.NoError(t, err)
+	require.Equal(t, "FIELD0", a.Field1)
+}
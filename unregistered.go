@@ -0,0 +1,225 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/asdine/storm-migrator/v0.5/codec"
+	"github.com/boltdb/bolt"
+)
+
+// ForeignBucket is a bucket that wasn't created by Storm, its content is unknown.
+const ForeignBucket = "foreign"
+
+// UnregisteredPolicy tells what to do with the top level buckets of the source database
+// that were not registered. By default, the migration fails if buckets created with Save or Init
+// were not registered and would be left in their old layout, the other buckets are copied as they are.
+type UnregisteredPolicy int
+
+// Policies for the unregistered buckets.
+const (
+	// CopyVerbatim copies the buckets to the destination as they are
+	CopyVerbatim UnregisteredPolicy = iota + 1
+	// Fail stops the migration before anything is written
+	Fail
+	// Skip leaves the buckets out of the destination
+	Skip
+	// RawMigrate migrates the buckets created with Save or Init without their type, like the Raw option.
+	// The other buckets are copied as they are
+	RawMigrate
+)
+
+// OnUnregistered option sets what to do with the top level buckets of the source database that were not registered.
+// Every unregistered bucket is reported with a BucketUnregistered event, whatever the policy.
+func OnUnregistered(p UnregisteredPolicy) func(*Migrator) error {
+	return func(m *Migrator) error {
+		if p < CopyVerbatim || p > RawMigrate {
+			return fmt.Errorf("invalid unregistered buckets policy %d", p)
+		}
+		m.onUnregistered = p
+		return nil
+	}
+}
+
+// UnregisteredBucketsError is returned by Run when the source database contains buckets that were not registered
+// and the Fail policy is used. Without a policy, it is returned when buckets created with Save or Init
+// were not registered and steps must be run, it then only lists these buckets.
+type UnregisteredBucketsError struct {
+	// Kind of each bucket: TypeBucket, KVBucket or ForeignBucket, by bucket name
+	Buckets map[string]string
+}
+
+func (e *UnregisteredBucketsError) Error() string {
+	names := make([]string, 0, len(e.Buckets))
+	for name := range e.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]string, len(names))
+	for i, name := range names {
+		list[i] = fmt.Sprintf("%s (%s)", name, e.Buckets[name])
+	}
+
+	return fmt.Sprintf("%d buckets are not registered: %s", len(list), strings.Join(list, ", "))
+}
+
+// registered returns the names of the top level buckets of the source database that were registered,
+// including the ones used by Storm and the migrator.
+func (m *Migrator) registered() map[string]bool {
+	registered := map[string]bool{
+		dbinfoBucket:   true,
+		metadataBucket: true,
+		historyBucket:  true,
+	}
+
+	for _, inst := range m.instances {
+		registered[m.sourceName(bucketName(inst))] = true
+	}
+
+	// the nested buckets are not inspected
+	for _, n := range m.nodes {
+		if len(n.Path) > 0 {
+			registered[n.Path[0]] = true
+		}
+	}
+
+	for _, name := range m.kvBuckets() {
+		registered[m.sourceName(name)] = true
+	}
+
+	return registered
+}
+
+// unregistered returns the kind of the top level buckets that were not registered, by bucket name.
+func (m *Migrator) unregistered(tx *bolt.Tx) map[string]string {
+	registered := m.registered()
+
+	buckets := make(map[string]string)
+	_ = tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if !registered[string(name)] {
+			buckets[string(name)] = classifyBucket(b, m.codecOf(string(name)))
+		}
+		return nil
+	})
+
+	return buckets
+}
+
+// classifyBucket guesses the kind of a bucket from its content. Buckets created with Save or Init
+// have indexes or metadata, buckets created with Set only contain values encoded with the codec.
+func classifyBucket(b *bolt.Bucket, c codec.MarshalUnmarshaler) string {
+	kind := KVBucket
+	sampled := 0
+	_ = b.ForEach(func(k, v []byte) error {
+		switch {
+		case v == nil && (string(k) == metadataBucket || bytes.HasPrefix(k, []byte(indexPrefix))):
+			kind = TypeBucket
+		case v == nil:
+			if kind == KVBucket {
+				kind = ForeignBucket
+			}
+		case sampled < detectSampleSize && kind == KVBucket:
+			sampled++
+			var value interface{}
+			if c.Unmarshal(v, &value) != nil {
+				kind = ForeignBucket
+			}
+		}
+		return nil
+	})
+
+	return kind
+}
+
+// checkUnregistered applies the policy to the unregistered buckets of the source database, before it is copied.
+// It returns the names of the buckets to leave out of the destination.
+func (m *Migrator) checkUnregistered() ([]string, error) {
+	b, err := openSource(m.path)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	var buckets map[string]string
+	err = b.View(func(tx *bolt.Tx) error {
+		buckets = m.unregistered(tx)
+		return nil
+	})
+	if err != nil || len(buckets) == 0 {
+		return nil, err
+	}
+
+	if m.onUnregistered == Fail {
+		return nil, &UnregisteredBucketsError{Buckets: buckets}
+	}
+
+	if m.onUnregistered == 0 {
+		err = m.checkUnregisteredTypes(buckets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.onUnregistered == RawMigrate {
+		err = m.checkRawCodec(buckets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(buckets))
+	for name := range buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m.emit(Event{Type: BucketUnregistered, Bucket: name, Kind: buckets[name]})
+	}
+
+	if m.onUnregistered != Skip {
+		return nil, nil
+	}
+	return names, nil
+}
+
+// checkUnregisteredTypes fails if buckets created with Save or Init were not registered
+// and the steps would leave them in the layout of the source version.
+func (m *Migrator) checkUnregisteredTypes(buckets map[string]string) error {
+	types := make(map[string]string)
+	for name, kind := range buckets {
+		if kind == TypeBucket {
+			types[name] = kind
+		}
+	}
+	if len(types) == 0 {
+		return nil
+	}
+
+	_, steps, err := m.sourcePath()
+	if err != nil || len(steps) == 0 {
+		return err
+	}
+
+	return &UnregisteredBucketsError{Buckets: types}
+}
+
+// dropBuckets deletes the given top level buckets, if they exist.
+func dropBuckets(b *bolt.DB, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	return b.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,122 @@
+package migrator_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnUnregistered(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = dbv04.Save(&Indexed{ID: i + 1, Name: fmt.Sprintf("name%d", i%2)})
+		require.NoError(t, err)
+	}
+	err = dbv04.Bolt.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("foreign"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("key"), []byte{0, 1, 2})
+	})
+	require.NoError(t, err)
+	dbv04.Close()
+
+	kinds := map[string]string{
+		"Indexed": migrator.TypeBucket,
+		"bucket":  migrator.KVBucket,
+		"foreign": migrator.ForeignBucket,
+	}
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	r, err := m.Plan()
+	require.NoError(t, err)
+	require.Equal(t, []string{"Indexed", "bucket", "foreign"}, r.Unregistered)
+	require.Equal(t, kinds, r.UnregisteredKinds)
+	require.Contains(t, r.String(), "foreign (foreign)")
+
+	err = m.Run(filepath.Join(dir, "failed.db"), migrator.OnUnregistered(migrator.Fail))
+	var uerr *migrator.UnregisteredBucketsError
+	require.True(t, errors.As(err, &uerr))
+	require.Equal(t, kinds, uerr.Buckets)
+	require.EqualError(t, err, "3 buckets are not registered: Indexed (type), bucket (kv), foreign (foreign)")
+	_, err = os.Stat(filepath.Join(dir, "failed.db"))
+	require.True(t, os.IsNotExist(err))
+
+	err = m.Run(filepath.Join(dir, "invalid.db"), migrator.OnUnregistered(migrator.UnregisteredPolicy(0)))
+	require.Error(t, err)
+
+	// by default, only the buckets created with Save would be left in their old layout
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B))
+	err = m.Run(filepath.Join(dir, "default.db"))
+	require.True(t, errors.As(err, &uerr))
+	require.Equal(t, map[string]string{"Indexed": migrator.TypeBucket}, uerr.Buckets)
+	_, err = os.Stat(filepath.Join(dir, "default.db"))
+	require.True(t, os.IsNotExist(err))
+
+	err = m.Run(filepath.Join(dir, "copied.db"), migrator.OnUnregistered(migrator.CopyVerbatim))
+	require.NoError(t, err)
+
+	// the buckets are reported whatever the policy
+	var reported []string
+	err = m.Run(filepath.Join(dir, "skipped.db"), migrator.OnUnregistered(migrator.Skip), migrator.OnEvent(func(e migrator.Event) {
+		if e.Type == migrator.BucketUnregistered {
+			require.Equal(t, kinds[e.Bucket], e.Kind)
+			reported = append(reported, e.Bucket)
+		}
+	}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"Indexed", "bucket", "foreign"}, reported)
+
+	db, err := stormv06.Open(filepath.Join(dir, "skipped.db"))
+	require.NoError(t, err)
+	err = db.Bolt.View(func(tx *bolt.Tx) error {
+		for name := range kinds {
+			require.Nil(t, tx.Bucket([]byte(name)))
+		}
+		require.NotNil(t, tx.Bucket([]byte("A")))
+		return nil
+	})
+	require.NoError(t, err)
+	db.Close()
+
+	err = m.Run(filepath.Join(dir, "raw.db"), migrator.OnUnregistered(migrator.RawMigrate))
+	require.NoError(t, err)
+
+	db, err = stormv06.Open(filepath.Join(dir, "raw.db"))
+	require.NoError(t, err)
+
+	var list []Indexed
+	err = db.Find("Name", "name0", &list)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+
+	// the other buckets are copied as they are
+	err = db.Bolt.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte{0, 1, 2}, tx.Bucket([]byte("foreign")).Get([]byte("key")))
+		require.NotNil(t, tx.Bucket([]byte("bucket")))
+		return nil
+	})
+	require.NoError(t, err)
+	db.Close()
+
+	// nothing is left in an old layout if there is no step to run
+	m = migrator.New(filepath.Join(dir, "raw.db"))
+	m.AddBuckets(new(A), new(B))
+	err = m.Run(filepath.Join(dir, "same.db"))
+	require.NoError(t, err)
+}
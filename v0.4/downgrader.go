@@ -0,0 +1,390 @@
+package storm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"sort"
+
+	"github.com/asdine/storm-migrator/v0.4/codec"
+	"github.com/boltdb/bolt"
+)
+
+// bucket used by Storm v0.5 and later to store the version
+const dbinfo = "__storm_db"
+
+// Number of records saved in a single transaction by default
+const defaultBatchSize = 1000
+
+// NewDowngrader instantiates a new Downgrader
+func NewDowngrader(db *bolt.DB, codec codec.EncodeDecoder, options ...func(*Downgrader)) *Downgrader {
+	d := Downgrader{boltDB: db, codec: codec, batchSize: defaultBatchSize}
+	for _, option := range options {
+		option(&d)
+	}
+
+	return &d
+}
+
+// DowngraderBucketCodec option sets the codec used by the given bucket, for its records and its keys,
+// instead of the one given to NewDowngrader.
+func DowngraderBucketCodec(bucketName string, c codec.EncodeDecoder) func(*Downgrader) {
+	return func(d *Downgrader) {
+		if d.codecs == nil {
+			d.codecs = make(map[string]codec.EncodeDecoder)
+		}
+		d.codecs[bucketName] = c
+	}
+}
+
+// DowngraderBatchSize option sets the number of records saved in a single transaction.
+func DowngraderBatchSize(n int) func(*Downgrader) {
+	return func(d *Downgrader) {
+		if n > 0 {
+			d.batchSize = n
+		}
+	}
+}
+
+// Downgrader migrates a database created with Storm v0.5 back to v0.4
+type Downgrader struct {
+	boltDB    *bolt.DB
+	codec     codec.EncodeDecoder
+	codecs    map[string]codec.EncodeDecoder
+	batchSize int
+}
+
+// codecOf returns the codec used by the given bucket.
+func (d *Downgrader) codecOf(bucketName string) codec.EncodeDecoder {
+	if c, ok := d.codecs[bucketName]; ok {
+		return c
+	}
+
+	return d.codec
+}
+
+// dbFor returns the database to use with the given bucket,
+// opened with the codec registered for the bucket if any.
+func (d *Downgrader) dbFor(db *DB, bucketName string) (*DB, error) {
+	c, ok := d.codecs[bucketName]
+	if !ok {
+		return db, nil
+	}
+
+	return Open("", UseDB(d.boltDB), Codec(c))
+}
+
+// Run the migration
+func (d *Downgrader) Run(instances []interface{}, kvKeys map[string][]interface{}) error {
+	db, err := Open("", UseDB(d.boltDB), Codec(d.codec))
+	if err != nil {
+		return err
+	}
+
+	var current string
+	err = db.Bolt.View(func(tx *bolt.Tx) error {
+		current = stagedBucket(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range resumeFirst(instances, current) {
+		err = d.runSaved(db, inst)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(kvKeys))
+	for bucketName := range kvKeys {
+		names = append(names, bucketName)
+	}
+	sort.Strings(names)
+
+	for _, bucketName := range names {
+		err = d.runSet(db, bucketName, kvKeys[bucketName])
+		if err != nil {
+			return err
+		}
+	}
+
+	// move the version back to the global metadata bucket
+	return db.Bolt.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(dbinfo))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		return db.WithTransaction(tx).Set(metadataBucket, "version", Version)
+	})
+}
+
+// resumeFirst moves the instance of the bucket whose downgrade was interrupted
+// at the beginning of the list, so its staged records are saved back before anything else.
+func resumeFirst(instances []interface{}, current string) []interface{} {
+	if current == "" {
+		return instances
+	}
+
+	list := make([]interface{}, 0, len(instances))
+	for _, inst := range instances {
+		if reflect.Indirect(reflect.ValueOf(inst)).Type().Name() == current {
+			list = append([]interface{}{inst}, list...)
+		} else {
+			list = append(list, inst)
+		}
+	}
+
+	return list
+}
+
+// runSaved resaves all the records of the bucket so ids and indexes
+// are encoded with the codec and the metadata bucket is removed.
+// The raw records are copied to the staging bucket and the bucket is dropped,
+// then the records are decoded and saved back. Records are processed in batches,
+// each of them in its own transaction.
+func (d *Downgrader) runSaved(db *DB, inst interface{}) error {
+	ref := reflect.Indirect(reflect.ValueOf(inst))
+	info, err := extract(&ref)
+	if err != nil {
+		return err
+	}
+
+	db, err = d.dbFor(db, info.Name)
+	if err != nil {
+		return err
+	}
+
+	err = db.Bolt.Update(func(tx *bolt.Tx) error {
+		return startStaging(tx, info.Name)
+	})
+	if err != nil {
+		return err
+	}
+
+	// copy the records to the staging bucket
+	for copied := false; !copied; {
+		err = db.Bolt.Update(func(tx *bolt.Tx) error {
+			s, err := staging(tx)
+			if err != nil {
+				return err
+			}
+
+			if s.Get([]byte(stagingCopied)) != nil {
+				copied = true
+				return nil
+			}
+
+			bucket := tx.Bucket([]byte(info.Name))
+			records := s.Bucket([]byte(stagingRecords))
+			var last []byte
+			if bucket != nil {
+				last, err = d.batch(bucket, s.Get([]byte(stagingKey)), records.Put)
+				if err != nil {
+					return err
+				}
+			}
+
+			if last != nil {
+				return s.Put([]byte(stagingKey), last)
+			}
+
+			// all the records are copied, drop the bucket if it has any.
+			// Its sequence is kept so that AutoIncrement doesn't reuse the ids
+			if k, _ := records.Cursor().First(); k != nil {
+				raw := make([]byte, 8)
+				binary.BigEndian.PutUint64(raw, bucket.Sequence())
+				err = s.Put([]byte(stagingSequence), raw)
+				if err != nil {
+					return err
+				}
+
+				err = tx.DeleteBucket([]byte(info.Name))
+				if err != nil {
+					return err
+				}
+			}
+
+			err = deleteKey(s, []byte(stagingKey))
+			if err != nil {
+				return err
+			}
+
+			return s.Put([]byte(stagingCopied), []byte{1})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// save the records back
+	for last := []byte(nil); ; {
+		err = db.Bolt.Update(func(tx *bolt.Tx) error {
+			s, err := staging(tx)
+			if err != nil {
+				return err
+			}
+
+			n := db.WithTransaction(tx)
+			last, err = d.batch(s.Bucket([]byte(stagingRecords)), s.Get([]byte(stagingKey)), func(k, v []byte) error {
+				newElem := reflect.New(ref.Type())
+				err := d.codecOf(info.Name).Decode(v, newElem.Interface())
+				if err != nil {
+					return err
+				}
+
+				return n.Save(newElem.Interface())
+			})
+			if err != nil {
+				return err
+			}
+
+			if last != nil {
+				return s.Put([]byte(stagingKey), last)
+			}
+
+			err = restoreSequence(tx, s, info.Name)
+			if err != nil {
+				return err
+			}
+
+			return clearStaging(tx)
+		})
+		if err != nil || last == nil {
+			return err
+		}
+	}
+}
+
+// batch calls fn with at most batchSize records of the bucket, starting after the given key.
+// It returns the last key processed, or nil if there are no more records.
+func (d *Downgrader) batch(b *bolt.Bucket, after []byte, fn func(k, v []byte) error) ([]byte, error) {
+	cursor := b.Cursor()
+	k, v := cursor.First()
+	if after != nil {
+		k, v = cursor.Seek(after)
+		if bytes.Equal(k, after) {
+			k, v = cursor.Next()
+		}
+	}
+
+	var last []byte
+	for i := 0; k != nil && i < d.batchSize; k, v = cursor.Next() {
+		if v == nil {
+			continue
+		}
+
+		err := fn(k, v)
+		if err != nil {
+			return nil, err
+		}
+
+		last = k
+		i++
+	}
+
+	if last == nil {
+		return nil, nil
+	}
+
+	return append([]byte(nil), last...), nil
+}
+
+// runSet encodes the integer keys with the codec and removes the metadata bucket.
+func (d *Downgrader) runSet(db *DB, bucketName string, instances []interface{}) error {
+	return db.Bolt.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		err := bucket.DeleteBucket([]byte(metadataBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		var keys, newKeys, values [][]byte
+		err = bucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+
+			newKey, err := d.matchKey(k, instances, d.codecOf(bucketName))
+			if err != nil || newKey == nil {
+				return err
+			}
+
+			keys = append(keys, append([]byte(nil), k...))
+			newKeys = append(newKeys, newKey)
+			values = append(values, append([]byte(nil), v...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range keys {
+			err = bucket.Delete(keys[i])
+			if err != nil {
+				return err
+			}
+
+			err = bucket.Put(newKeys[i], values[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// matchKey returns the key encoded by Storm v0.4 if the first instance that matches
+// is an integer, or nil if the key doesn't need to be converted.
+func (d *Downgrader) matchKey(k []byte, instances []interface{}, c codec.EncodeDecoder) ([]byte, error) {
+	for _, inst := range instances {
+		t := reflect.Indirect(reflect.ValueOf(inst)).Type()
+		switch {
+		case t.Kind() == reflect.String, t.AssignableTo(reflect.TypeOf([]byte{})):
+			return nil, nil
+		case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+			// Storm v0.5 stores int and uint keys using 8 bytes
+			size := int(t.Size())
+			if t.Kind() == reflect.Int || t.Kind() == reflect.Uint {
+				size = 8
+			}
+			if len(k) != size {
+				continue
+			}
+
+			return d.decodeNumber(k, t, c)
+		default:
+			if c.Decode(k, inst) == nil {
+				return nil, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (d *Downgrader) decodeNumber(k []byte, t reflect.Type, c codec.EncodeDecoder) ([]byte, error) {
+	var v reflect.Value
+	switch t.Kind() {
+	case reflect.Int:
+		v = reflect.New(reflect.TypeOf(int64(0)))
+	case reflect.Uint:
+		v = reflect.New(reflect.TypeOf(uint64(0)))
+	default:
+		v = reflect.New(t)
+	}
+
+	err := binary.Read(bytes.NewReader(k), binary.BigEndian, v.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	return toBytes(v.Elem().Convert(t).Interface(), c)
+}
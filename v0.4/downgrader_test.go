@@ -0,0 +1,181 @@
+package storm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asdine/storm-migrator/v0.4/codec/json"
+	stormv05 "github.com/asdine/storm-migrator/v0.5"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDowngrader(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "storm")
+	defer os.RemoveAll(dir)
+
+	dbv05, err := stormv05.Open(filepath.Join(dir, "my.db"))
+	require.NoError(t, err)
+	defer dbv05.Close()
+
+	type User struct {
+		ID   int    `storm:"id"`
+		Name string `storm:"index"`
+		Age  int    `storm:"index"`
+	}
+
+	for i := 0; i < 10; i++ {
+		group := "odd"
+		if i%2 == 0 {
+			group = "even"
+		}
+		err = dbv05.Save(&User{ID: i + 1, Name: group, Age: i})
+		require.NoError(t, err)
+	}
+
+	err = dbv05.Set("bucket", "string", "value")
+	require.NoError(t, err)
+	err = dbv05.Set("bucket", 1, "value")
+	require.NoError(t, err)
+	err = dbv05.Set("bucket", uint16(2), "value")
+	require.NoError(t, err)
+	err = dbv05.Set("bucket", User{ID: 10}, "value")
+	require.NoError(t, err)
+
+	d := NewDowngrader(dbv05.Bolt, json.Codec)
+	err = d.Run([]interface{}{new(User)}, map[string][]interface{}{
+		"bucket": {new(int), new(uint16), new(User), new(string)},
+	})
+	require.NoError(t, err)
+
+	dbv04, err := Open("", UseDB(dbv05.Bolt))
+	require.NoError(t, err)
+
+	var version string
+	err = dbv04.Get(metadataBucket, "version", &version)
+	require.NoError(t, err)
+	require.Equal(t, Version, version)
+
+	err = dbv04.Bolt.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte(dbinfo)))
+		require.Nil(t, tx.Bucket([]byte("User")).Bucket([]byte(metadataBucket)))
+		require.Nil(t, tx.Bucket([]byte("bucket")).Bucket([]byte(metadataBucket)))
+		return nil
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		var u User
+		err = dbv04.One("ID", i+1, &u)
+		require.NoError(t, err)
+		require.Equal(t, i, u.Age)
+	}
+
+	var users []User
+	err = dbv04.Find("Age", 4, &users)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, 5, users[0].ID)
+
+	err = dbv04.Find("Name", "even", &users)
+	require.NoError(t, err)
+	require.Len(t, users, 5)
+
+	var s string
+	err = dbv04.Get("bucket", "string", &s)
+	require.NoError(t, err)
+	err = dbv04.Get("bucket", 1, &s)
+	require.NoError(t, err)
+	err = dbv04.Get("bucket", uint16(2), &s)
+	require.NoError(t, err)
+	err = dbv04.Get("bucket", User{ID: 10}, &s)
+	require.NoError(t, err)
+}
+
+func TestDowngraderSequence(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "storm")
+	defer os.RemoveAll(dir)
+
+	dbv05, err := stormv05.Open(filepath.Join(dir, "my.db"), stormv05.AutoIncrement())
+	require.NoError(t, err)
+	defer dbv05.Close()
+
+	type User struct {
+		ID   int    `storm:"id"`
+		Name string `storm:"index"`
+	}
+
+	for i := 0; i < 10; i++ {
+		err = dbv05.Save(&User{Name: "John"})
+		require.NoError(t, err)
+	}
+
+	d := NewDowngrader(dbv05.Bolt, json.Codec)
+	err = d.Run([]interface{}{new(User)}, nil)
+	require.NoError(t, err)
+
+	dbv04, err := Open("", UseDB(dbv05.Bolt), AutoIncrement())
+	require.NoError(t, err)
+
+	// the sequence of the bucket is kept when the records are saved back
+	u := User{Name: "John"}
+	err = dbv04.Save(&u)
+	require.NoError(t, err)
+	require.Equal(t, 11, u.ID)
+}
+
+func TestDowngraderBatches(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "storm")
+	defer os.RemoveAll(dir)
+
+	dbv05, err := stormv05.Open(filepath.Join(dir, "my.db"))
+	require.NoError(t, err)
+	defer dbv05.Close()
+
+	type User struct {
+		ID   int    `storm:"id"`
+		Name string `storm:"index"`
+	}
+
+	for i := 0; i < 10; i++ {
+		err = dbv05.Save(&User{ID: i + 1, Name: "John"})
+		require.NoError(t, err)
+	}
+
+	// the last record can't be decoded, the downgrade fails once the bucket is dropped
+	err = dbv05.Bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("User")).Put([]byte{0xff}, []byte("{"))
+	})
+	require.NoError(t, err)
+
+	d := NewDowngrader(dbv05.Bolt, json.Codec, DowngraderBatchSize(3))
+	err = d.Run([]interface{}{new(User)}, nil)
+	require.Error(t, err)
+
+	// fix the staged record and resume
+	err = dbv05.Bolt.Update(func(tx *bolt.Tx) error {
+		records := tx.Bucket([]byte(dbinfo)).Bucket([]byte(stagingBucket)).Bucket([]byte(stagingRecords))
+		return records.Put([]byte{0xff}, []byte(`{"ID":11,"Name":"John"}`))
+	})
+	require.NoError(t, err)
+
+	err = d.Run([]interface{}{new(User)}, nil)
+	require.NoError(t, err)
+
+	dbv04, err := Open("", UseDB(dbv05.Bolt))
+	require.NoError(t, err)
+
+	var users []User
+	err = dbv04.Find("Name", "John", &users)
+	require.NoError(t, err)
+	require.Len(t, users, 11)
+
+	// the staging bucket is removed with the dbinfo bucket
+	err = dbv05.Bolt.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte(dbinfo)))
+		return nil
+	})
+	require.NoError(t, err)
+}
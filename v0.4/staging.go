@@ -0,0 +1,123 @@
+package storm
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// The records of the bucket being downgraded are staged in a bucket nested in the dbinfo bucket,
+// so an interrupted downgrade can be resumed. It is removed with the dbinfo bucket at the end of the downgrade.
+const (
+	stagingBucket = "downgrade"
+	// raw records of the bucket being downgraded
+	stagingRecords = "records"
+	// name of the bucket being downgraded
+	stagingCurrent = "bucket"
+	// last key copied to or saved from the records bucket
+	stagingKey = "key"
+	// set once all the records are copied to the records bucket
+	stagingCopied = "copied"
+	// sequence of the bucket being downgraded, restored once its records are saved back
+	stagingSequence = "sequence"
+)
+
+// staging returns the staging bucket, creating it if needed.
+func staging(tx *bolt.Tx) (*bolt.Bucket, error) {
+	info, err := tx.CreateBucketIfNotExists([]byte(dbinfo))
+	if err != nil {
+		return nil, err
+	}
+
+	return info.CreateBucketIfNotExists([]byte(stagingBucket))
+}
+
+// stagedBucket returns the name of the bucket whose downgrade was interrupted, if any.
+func stagedBucket(tx *bolt.Tx) string {
+	info := tx.Bucket([]byte(dbinfo))
+	if info == nil {
+		return ""
+	}
+
+	s := info.Bucket([]byte(stagingBucket))
+	if s == nil {
+		return ""
+	}
+
+	return string(s.Get([]byte(stagingCurrent)))
+}
+
+// startStaging resets the staging bucket before downgrading the given bucket,
+// unless the downgrade of that bucket was interrupted.
+func startStaging(tx *bolt.Tx, bucketName string) error {
+	if stagedBucket(tx) == bucketName {
+		return nil
+	}
+
+	err := clearStaging(tx)
+	if err != nil {
+		return err
+	}
+
+	s, err := staging(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.CreateBucket([]byte(stagingRecords))
+	if err != nil {
+		return err
+	}
+
+	return s.Put([]byte(stagingCurrent), []byte(bucketName))
+}
+
+// restoreSequence sets the sequence of the bucket saved in the staging bucket, if any.
+func restoreSequence(tx *bolt.Tx, s *bolt.Bucket, bucketName string) error {
+	raw := s.Get([]byte(stagingSequence))
+	if raw == nil {
+		return nil
+	}
+
+	var seq uint64
+	err := binary.Read(bytes.NewReader(raw), binary.BigEndian, &seq)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+
+	if bucket.Sequence() >= seq {
+		return nil
+	}
+	return bucket.SetSequence(seq)
+}
+
+// deleteKey deletes a key if it exists. Bolt fails to delete a missing key
+// if the following one is a bucket.
+func deleteKey(b *bolt.Bucket, key []byte) error {
+	if b.Get(key) == nil {
+		return nil
+	}
+
+	return b.Delete(key)
+}
+
+// clearStaging removes the staging bucket.
+func clearStaging(tx *bolt.Tx) error {
+	info := tx.Bucket([]byte(dbinfo))
+	if info == nil {
+		return nil
+	}
+
+	err := info.DeleteBucket([]byte(stagingBucket))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package storm
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// The checkpoint of a migration is stored in a bucket nested in the dbinfo bucket
+// so an interrupted migration can be resumed.
+const (
+	checkpointBucket = "checkpoint"
+	// buckets that are fully migrated
+	checkpointDone = "done"
+	// raw records of the bucket being migrated
+	checkpointRecords = "records"
+	// name of the bucket being migrated
+	checkpointCurrent = "bucket"
+	// last key copied to or saved from the records bucket
+	checkpointKey = "key"
+	// set once all the records are copied to the records bucket
+	checkpointCopied = "copied"
+	// sequence of the bucket being migrated, restored once its records are saved back
+	checkpointSequence = "sequence"
+)
+
+// checkpoint returns the checkpoint bucket, creating it if needed.
+func checkpoint(tx *bolt.Tx) (*bolt.Bucket, error) {
+	info, err := tx.CreateBucketIfNotExists([]byte(dbinfo))
+	if err != nil {
+		return nil, err
+	}
+
+	return info.CreateBucketIfNotExists([]byte(checkpointBucket))
+}
+
+// isDone reports whether the given bucket was already migrated.
+func isDone(tx *bolt.Tx, bucketName string) (bool, error) {
+	c, err := checkpoint(tx)
+	if err != nil {
+		return false, err
+	}
+
+	done := c.Bucket([]byte(checkpointDone))
+	return done != nil && done.Get([]byte(bucketName)) != nil, nil
+}
+
+// markDone records that the given bucket is migrated and clears the records copied for it.
+func markDone(tx *bolt.Tx, bucketName string) error {
+	c, err := checkpoint(tx)
+	if err != nil {
+		return err
+	}
+
+	done, err := c.CreateBucketIfNotExists([]byte(checkpointDone))
+	if err != nil {
+		return err
+	}
+
+	err = done.Put([]byte(bucketName), []byte{1})
+	if err != nil {
+		return err
+	}
+
+	err = c.DeleteBucket([]byte(checkpointRecords))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+
+	for _, k := range []string{checkpointCurrent, checkpointKey, checkpointCopied, checkpointSequence} {
+		err = deleteKey(c, []byte(k))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startCheckpoint resets the records bucket before migrating the given bucket.
+func startCheckpoint(tx *bolt.Tx, bucketName string) error {
+	c, err := checkpoint(tx)
+	if err != nil {
+		return err
+	}
+
+	err = c.DeleteBucket([]byte(checkpointRecords))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+
+	_, err = c.CreateBucket([]byte(checkpointRecords))
+	if err != nil {
+		return err
+	}
+
+	for _, k := range []string{checkpointKey, checkpointCopied, checkpointSequence} {
+		err = deleteKey(c, []byte(k))
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.Put([]byte(checkpointCurrent), []byte(bucketName))
+}
+
+// deleteKey deletes a key if it exists. Bolt fails to delete a missing key
+// if the following one is a bucket.
+func deleteKey(b *bolt.Bucket, key []byte) error {
+	if b.Get(key) == nil {
+		return nil
+	}
+
+	return b.Delete(key)
+}
+
+// clearCheckpoint removes the checkpoint once the migration is over.
+func clearCheckpoint(tx *bolt.Tx) error {
+	info := tx.Bucket([]byte(dbinfo))
+	if info == nil {
+		return nil
+	}
+
+	err := info.DeleteBucket([]byte(checkpointBucket))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+
+	return nil
+}
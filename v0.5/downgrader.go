@@ -0,0 +1,184 @@
+package storm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+
+	"github.com/asdine/storm-migrator/v0.5/codec"
+	"github.com/boltdb/bolt"
+)
+
+// NewDowngrader instantiates a new Downgrader
+func NewDowngrader(db *bolt.DB, codec codec.MarshalUnmarshaler, options ...func(*Downgrader)) *Downgrader {
+	d := Downgrader{boltDB: db, codec: codec}
+	for _, option := range options {
+		option(&d)
+	}
+
+	return &d
+}
+
+// DowngraderBucketCodec option sets the codec used by the records of the given bucket,
+// instead of the one given to NewDowngrader.
+func DowngraderBucketCodec(bucketName string, c codec.MarshalUnmarshaler) func(*Downgrader) {
+	return func(d *Downgrader) {
+		if d.codecs == nil {
+			d.codecs = make(map[string]codec.MarshalUnmarshaler)
+		}
+		d.codecs[bucketName] = c
+	}
+}
+
+// Downgrader migrates a database created with Storm v0.6 back to v0.5
+type Downgrader struct {
+	boltDB *bolt.DB
+	codec  codec.MarshalUnmarshaler
+	codecs map[string]codec.MarshalUnmarshaler
+}
+
+// codecOf returns the codec used by the records of the given bucket.
+func (d *Downgrader) codecOf(bucketName string) codec.MarshalUnmarshaler {
+	if c, ok := d.codecs[bucketName]; ok {
+		return c
+	}
+
+	return d.codec
+}
+
+// Run the migration. Key value buckets are stored the same way by v0.5 and v0.6,
+// they are left untouched.
+func (d *Downgrader) Run(instances []interface{}, kvKeys map[string][]interface{}) error {
+	db, err := Open("", UseDB(d.boltDB), Codec(d.codec))
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range instances {
+		err = db.Bolt.Update(func(tx *bolt.Tx) error {
+			return d.downgrade(tx, inst)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// set old version
+	return db.Set(dbinfo, "version", "0.5.0")
+}
+
+// downgrade removes the increment counters from the bucket metadata
+// and rebuilds the list indexes using one bucket per value.
+// The counter of the id is moved to the sequence of the bucket, used by AutoIncrement.
+func (d *Downgrader) downgrade(tx *bolt.Tx, inst interface{}) error {
+	ref := reflect.Indirect(reflect.ValueOf(inst))
+	info, err := extract(&ref)
+	if err != nil {
+		return err
+	}
+
+	bucket := tx.Bucket([]byte(info.Name))
+	if bucket == nil {
+		return nil
+	}
+
+	// strip the counters
+	if meta := bucket.Bucket([]byte(metadataBucket)); meta != nil {
+		var counters [][]byte
+		err = meta.ForEach(func(k, v []byte) error {
+			if v != nil && bytes.HasSuffix(k, []byte("counter")) {
+				counters = append(counters, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range counters {
+			if string(k) == info.ID.FieldName+"counter" {
+				var counter int64
+				err = binary.Read(bytes.NewReader(meta.Get(k)), binary.BigEndian, &counter)
+				if err != nil {
+					return err
+				}
+
+				if counter > 0 && uint64(counter) > bucket.Sequence() {
+					err = bucket.SetSequence(uint64(counter))
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			err = meta.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// list the values to index before touching the bucket
+	type entry struct {
+		id, value []byte
+	}
+	entries := make(map[string][]entry)
+
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil {
+			continue
+		}
+
+		newElem := reflect.New(ref.Type())
+		err = d.codecOf(info.Name).Unmarshal(v, newElem.Interface())
+		if err != nil {
+			return err
+		}
+
+		recordInfo, err := extract(&newElem)
+		if err != nil {
+			return err
+		}
+
+		for fieldName, idxInfo := range recordInfo.Indexes {
+			if idxInfo.IsZero {
+				continue
+			}
+
+			value, err := toBytes(idxInfo.Value.Interface(), d.codecOf(info.Name))
+			if err != nil {
+				return err
+			}
+
+			entries[fieldName] = append(entries[fieldName], entry{
+				id:    append([]byte(nil), k...),
+				value: value,
+			})
+		}
+	}
+
+	// drop the indexes created by v0.6
+	for fieldName := range info.Indexes {
+		err = bucket.DeleteBucket([]byte(indexPrefix + fieldName))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+
+	for fieldName, idxInfo := range info.Indexes {
+		idx, err := getIndex(bucket, idxInfo.Type, fieldName)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries[fieldName] {
+			err = idx.Add(e.value, e.id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
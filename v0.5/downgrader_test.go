@@ -0,0 +1,112 @@
+package storm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/asdine/storm-migrator/v0.6/codec/json"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDowngrader(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "storm")
+	defer os.RemoveAll(dir)
+
+	dbv06, err := stormv06.Open(filepath.Join(dir, "my.db"))
+	require.NoError(t, err)
+	defer dbv06.Close()
+
+	for i := 0; i < 10; i++ {
+		group := "odd"
+		if i%2 == 0 {
+			group = "even"
+		}
+		err = dbv06.Save(&User{ID: i + 1, Name: group, Slug: "slug" + string('a'+rune(i))})
+		require.NoError(t, err)
+	}
+
+	err = dbv06.Set("bucket", 10, "value")
+	require.NoError(t, err)
+
+	err = dbv06.Bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("User")).Bucket([]byte(metadataBucket)).Put([]byte("IDcounter"), []byte{0, 0, 0, 0, 0, 0, 0, 10})
+	})
+	require.NoError(t, err)
+
+	d := NewDowngrader(dbv06.Bolt, json.Codec)
+	err = d.Run([]interface{}{new(User)}, map[string][]interface{}{
+		"bucket": {new(int)},
+	})
+	require.NoError(t, err)
+
+	dbv05, err := Open("", UseDB(dbv06.Bolt))
+	require.NoError(t, err)
+
+	var version string
+	err = dbv05.Get(dbinfo, "version", &version)
+	require.NoError(t, err)
+	require.Equal(t, "0.5.0", version)
+
+	var users []User
+	err = dbv05.Find("Name", "even", &users)
+	require.NoError(t, err)
+	require.Len(t, users, 5)
+	for _, u := range users {
+		require.Equal(t, 1, u.ID%2)
+	}
+
+	var u User
+	err = dbv05.One("Slug", "slugc", &u)
+	require.NoError(t, err)
+	require.Equal(t, 3, u.ID)
+
+	err = dbv05.Save(&User{ID: 11, Name: "odd", Slug: "slugk"})
+	require.NoError(t, err)
+	err = dbv05.Find("Name", "odd", &users)
+	require.NoError(t, err)
+	require.Len(t, users, 6)
+
+	var s string
+	err = dbv05.Get("bucket", 10, &s)
+	require.NoError(t, err)
+	require.Equal(t, "value", s)
+
+	err = dbv05.Bolt.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte("User")).Bucket([]byte(metadataBucket))
+		require.Nil(t, meta.Get([]byte("IDcounter")))
+		require.Equal(t, []byte("json"), meta.Get([]byte("codec")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDowngraderSequence(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "storm")
+	defer os.RemoveAll(dir)
+
+	dbv06, err := stormv06.Open(filepath.Join(dir, "my.db"), stormv06.AutoIncrement())
+	require.NoError(t, err)
+	defer dbv06.Close()
+
+	for i := 0; i < 10; i++ {
+		err = dbv06.Save(&User{Name: "John", Slug: "slug" + string('a'+rune(i))})
+		require.NoError(t, err)
+	}
+
+	d := NewDowngrader(dbv06.Bolt, json.Codec)
+	err = d.Run([]interface{}{new(User)}, nil)
+	require.NoError(t, err)
+
+	dbv05, err := Open("", UseDB(dbv06.Bolt), AutoIncrement())
+	require.NoError(t, err)
+
+	// the counter of the ids is moved to the sequence of the bucket
+	u := User{Name: "John", Slug: "slugk"}
+	err = dbv05.Save(&u)
+	require.NoError(t, err)
+	require.Equal(t, 11, u.ID)
+}
@@ -1,27 +1,117 @@
 package storm
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/asdine/storm-migrator/v0.5/codec"
-	"github.com/asdine/storm-migrator/v0.5/q"
 	"github.com/boltdb/bolt"
 )
 
+// Number of records saved in a single transaction by default
+const defaultBatchSize = 1000
+
 // NewMigrator instantiates a new Migrator
-func NewMigrator(db *bolt.DB, codec codec.MarshalUnmarshaler) *Migrator {
-	return &Migrator{boltDB: db, codec: codec}
+func NewMigrator(db *bolt.DB, codec codec.MarshalUnmarshaler, options ...func(*Migrator)) *Migrator {
+	m := Migrator{boltDB: db, codec: codec, observer: nopObserver{}, batchSize: defaultBatchSize, ctx: context.Background()}
+	for _, option := range options {
+		option(&m)
+	}
+	return &m
 }
 
 // Migrator migrates the given database to v0.5
 type Migrator struct {
-	boltDB *bolt.DB
-	codec  codec.MarshalUnmarshaler
+	boltDB    *bolt.DB
+	codec     codec.MarshalUnmarshaler
+	observer  Observer
+	batchSize int
+	keyFuncs  map[string]func([]byte) (interface{}, error)
+	codecs    map[string]codec.MarshalUnmarshaler
+	// functions applied to the records before saving them, by bucket name
+	transforms map[string]func(reflect.Value) (interface{}, error)
+	// path of the node containing the migrated buckets, empty for the top level
+	root []string
+	// checked between records, the migration stops once it is done
+	ctx context.Context
+}
+
+// Observer is notified of the progress of the migration.
+type Observer interface {
+	// BucketStarted is called before migrating a bucket
+	BucketStarted(bucket string)
+	// RecordProcessed is called every time a record is migrated, with the number of records migrated so far
+	RecordProcessed(bucket string, count int)
+	// BucketFinished is called once a bucket is migrated, with the total number of records
+	BucketFinished(bucket string, count int)
+	// KeySkipped is called for every key that none of the registered instances can decode
+	KeySkipped(bucket string, key []byte)
+}
+
+// Observe option registers an Observer notified of the progress of the migration.
+func Observe(o Observer) func(*Migrator) {
+	return func(m *Migrator) {
+		m.observer = o
+	}
+}
+
+// BatchSize option sets the number of records saved in a single transaction.
+func BatchSize(n int) func(*Migrator) {
+	return func(m *Migrator) {
+		if n > 0 {
+			m.batchSize = n
+		}
+	}
+}
+
+// Context option sets a context checked between the records. Once it is done, the current transaction
+// is rolled back and Run returns its error. The records saved before are kept with the checkpoint,
+// running the migration again resumes it.
+func Context(ctx context.Context) func(*Migrator) {
+	return func(m *Migrator) {
+		m.ctx = ctx
+	}
+}
+
+// KeyFunc option registers a function that decodes the keys of the given bucket.
+// It is used instead of the instances given to Run for that bucket.
+// Keys for which it returns an error are left untouched.
+func KeyFunc(bucketName string, fn func(rawKey []byte) (interface{}, error)) func(*Migrator) {
+	return func(m *Migrator) {
+		if m.keyFuncs == nil {
+			m.keyFuncs = make(map[string]func([]byte) (interface{}, error))
+		}
+		m.keyFuncs[bucketName] = fn
+	}
+}
+
+// BucketCodec option sets the codec used by the records of the given top level bucket,
+// instead of the one given to NewMigrator. The buckets migrated with RunAt always use the codec given to NewMigrator.
+func BucketCodec(bucketName string, c codec.MarshalUnmarshaler) func(*Migrator) {
+	return func(m *Migrator) {
+		if m.codecs == nil {
+			m.codecs = make(map[string]codec.MarshalUnmarshaler)
+		}
+		m.codecs[bucketName] = c
+	}
 }
 
-// Run the migration
+type nopObserver struct{}
+
+func (nopObserver) BucketStarted(string)        {}
+func (nopObserver) RecordProcessed(string, int) {}
+func (nopObserver) BucketFinished(string, int)  {}
+func (nopObserver) KeySkipped(string, []byte)   {}
+
+// Run the migration. The progress is recorded in the database after every batch of records,
+// running the migration again on an interrupted database resumes it.
 func (m *Migrator) Run(instances []interface{}, kvKeys map[string][]interface{}) error {
-	db, err := Open("", UseDB(m.boltDB))
+	db, err := Open("", UseDB(m.boltDB), Codec(m.codec))
 	if err != nil {
 		return err
 	}
@@ -36,18 +126,118 @@ func (m *Migrator) Run(instances []interface{}, kvKeys map[string][]interface{})
 		return err
 	}
 
-	// drop the old metadata bucket
-	err = db.Drop(metadataBucket)
+	return db.Bolt.Update(func(tx *bolt.Tx) error {
+		// drop the old metadata bucket
+		err := tx.DeleteBucket([]byte(metadataBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		err = clearCheckpoint(tx)
+		if err != nil {
+			return err
+		}
+
+		// set new version
+		return db.WithTransaction(tx).Set(dbinfo, "version", "0.5.0")
+	})
+}
+
+// RunAt migrates the buckets nested under the node at the given path, created using the Root or From methods.
+// It must be called before Run, which bumps the version of the database. The functions registered with KeyFunc
+// only apply to the top level buckets. Nothing is done if the node doesn't exist.
+func (m *Migrator) RunAt(path []string, instances []interface{}, kvKeys map[string][]interface{}) error {
+	n := *m
+	n.root = append([]string(nil), path...)
+	n.keyFuncs = nil
+
+	db, err := Open("", UseDB(m.boltDB), Codec(m.codec), Root(n.root...))
+	if err != nil {
+		return err
+	}
+
+	err = n.runSaved(db, instances)
 	if err != nil {
 		return err
 	}
 
-	// set new version
-	return db.Set(dbinfo, "version", "0.5.0")
+	return n.runSet(db, kvKeys)
+}
+
+// container is a transaction or a bucket containing the migrated buckets.
+type container interface {
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucket(name []byte) (*bolt.Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// parent returns the container of the migrated buckets, or nil if the node doesn't exist.
+func (m *Migrator) parent(tx *bolt.Tx) container {
+	if len(m.root) == 0 {
+		return tx
+	}
+
+	b := tx.Bucket([]byte(m.root[0]))
+	for i := 1; b != nil && i < len(m.root); i++ {
+		b = b.Bucket([]byte(m.root[i]))
+	}
+
+	if b == nil {
+		return nil
+	}
+
+	return b
+}
+
+// bucket returns the given migrated bucket, or nil if it doesn't exist.
+func (m *Migrator) bucket(tx *bolt.Tx, bucketName string) *bolt.Bucket {
+	p := m.parent(tx)
+	if p == nil {
+		return nil
+	}
+
+	return p.Bucket([]byte(bucketName))
+}
+
+// migrationError adds the bucket and the key, if any, to an error that doesn't already have them.
+func (m *Migrator) migrationError(bucketName string, k []byte, err error) error {
+	var merr *MigrationError
+	if errors.As(err, &merr) {
+		return err
+	}
+
+	if k != nil {
+		k = append([]byte(nil), k...)
+	}
+	return &MigrationError{Bucket: m.name(bucketName), Key: k, Err: err}
+}
+
+// name returns the path of the bucket, used to identify it in the checkpoint and the notifications.
+func (m *Migrator) name(bucketName string) string {
+	return strings.Join(append(append([]string(nil), m.root...), bucketName), "/")
 }
 
 func (m *Migrator) runSaved(db *DB, instances []interface{}) error {
-	for _, inst := range instances {
+	var current string
+	err := db.Bolt.Update(func(tx *bolt.Tx) error {
+		c, err := checkpoint(tx)
+		if err != nil {
+			return err
+		}
+
+		current = string(c.Get([]byte(checkpointCurrent)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range m.resumeFirst(instances, current) {
+		err = m.ctx.Err()
+		if err != nil {
+			return err
+		}
+
 		// extract informations
 		ref := reflect.Indirect(reflect.ValueOf(inst))
 		info, err := extract(&ref)
@@ -55,105 +245,398 @@ func (m *Migrator) runSaved(db *DB, instances []interface{}) error {
 			return err
 		}
 
-		// create an empty slice
-		sliceType := reflect.SliceOf(ref.Type())
-		newSlice := reflect.New(sliceType)
-
-		// fetch all the records
-		err = db.All(newSlice.Interface())
+		bdb, err := m.dbFor(db, info.Name)
 		if err != nil {
 			return err
 		}
 
-		// drop the bucket
-		err = db.Drop(info.Name)
+		err = m.resave(bdb, ref.Type(), info.Name, m.name(info.Name) == current)
 		if err != nil {
 			return err
 		}
+	}
 
-		// resave all the records
-		s := newSlice.Elem()
-		l := s.Len()
-		for i := 0; i < l; i++ {
-			v := s.Index(i)
-			err = db.Save(v.Addr().Interface())
-			if err != nil {
-				return err
-			}
+	return nil
+}
+
+// dbFor returns the database to use with the given bucket,
+// opened with the codec registered for the bucket if it is a top level one.
+func (m *Migrator) dbFor(db *DB, bucketName string) (*DB, error) {
+	c, ok := m.codecs[bucketName]
+	if !ok || len(m.root) > 0 {
+		return db, nil
+	}
+
+	return Open("", UseDB(m.boltDB), Codec(c), Root(m.root...))
+}
+
+// resumeFirst moves the instance of the bucket whose migration was interrupted
+// at the beginning of the list.
+func (m *Migrator) resumeFirst(instances []interface{}, current string) []interface{} {
+	if current == "" {
+		return instances
+	}
+
+	list := make([]interface{}, 0, len(instances))
+	for _, inst := range instances {
+		if m.name(reflect.Indirect(reflect.ValueOf(inst)).Type().Name()) == current {
+			list = append([]interface{}{inst}, list...)
+		} else {
+			list = append(list, inst)
 		}
 	}
 
-	return nil
+	return list
 }
 
-func (m *Migrator) runSet(db *DB, kvKeys map[string][]interface{}) error {
-	for bucketName, instances := range kvKeys {
-		// fetch all keys and values from the bucket
-		var keys [][]byte
-		var values [][]byte
-		err := db.Select(q.True()).Bucket(bucketName).RawEach(func(k []byte, v []byte) error {
-			cpk := make([]byte, len(k))
-			cpv := make([]byte, len(v))
-			copy(cpk, k)
-			copy(cpv, v)
-			keys = append(keys, cpk)
-			values = append(values, cpv)
-			return nil
-		})
-		if err != nil {
+// resave streams the raw records of the bucket to the checkpoint and drops the bucket,
+// then decodes and saves the records back. Records are processed in batches, each of them in its own transaction.
+func (m *Migrator) resave(db *DB, typ reflect.Type, bucketName string, resume bool) error {
+	name := m.name(bucketName)
+
+	var done bool
+	err := db.Bolt.Update(func(tx *bolt.Tx) error {
+		var err error
+		done, err = isDone(tx, name)
+		if err != nil || done || resume {
 			return err
 		}
 
-		for i, k := range keys {
-			// find the right instance
-			for _, inst := range instances {
-				r := reflect.Indirect(reflect.ValueOf(inst))
-				t := r.Type()
-				switch {
-				case t.Kind() == reflect.String:
-					r.SetString(string(k))
-				case t.AssignableTo(reflect.TypeOf([]byte{})):
-					r.SetBytes(k)
-				default:
-					err = m.codec.Unmarshal(k, inst)
+		return startCheckpoint(tx, name)
+	})
+	if err != nil || done {
+		return err
+	}
+
+	m.observer.BucketStarted(name)
+
+	// copy the records to the checkpoint
+	for copied := false; !copied; {
+		err = db.Bolt.Update(func(tx *bolt.Tx) error {
+			c, err := checkpoint(tx)
+			if err != nil {
+				return err
+			}
+
+			if c.Get([]byte(checkpointCopied)) != nil {
+				copied = true
+				return nil
+			}
+
+			bucket := m.bucket(tx, bucketName)
+			records := c.Bucket([]byte(checkpointRecords))
+			var last []byte
+			if bucket != nil {
+				last, err = m.batch(bucket, c.Get([]byte(checkpointKey)), records.Put)
+				if err != nil {
+					return err
+				}
+			}
+
+			if last != nil {
+				return c.Put([]byte(checkpointKey), last)
+			}
+
+			// all the records are copied, drop the bucket.
+			// Its sequence is kept so that AutoIncrement doesn't reuse the ids
+			if bucket != nil {
+				if seq := bucket.Sequence(); seq > 0 {
+					raw, err := numbertob(seq)
+					if err != nil {
+						return err
+					}
+
+					err = c.Put([]byte(checkpointSequence), raw)
 					if err != nil {
-						// if it doesn't match, try another
-						continue
+						return err
 					}
 				}
 
-				// create new key
-				newKey, err := toBytes(r.Interface(), m.codec)
+				err = m.parent(tx).DeleteBucket([]byte(bucketName))
 				if err != nil {
 					return err
 				}
+			}
+
+			err = deleteKey(c, []byte(checkpointKey))
+			if err != nil {
+				return err
+			}
 
-				tx, err := db.Bolt.Begin(true)
+			return c.Put([]byte(checkpointCopied), []byte{1})
+		})
+		if err != nil {
+			return m.migrationError(bucketName, nil, err)
+		}
+	}
+
+	// save the records back
+	var count int
+	for last := []byte(nil); ; {
+		var saved int
+		err = db.Bolt.Update(func(tx *bolt.Tx) error {
+			c, err := checkpoint(tx)
+			if err != nil {
+				return err
+			}
+
+			n := db.WithTransaction(tx)
+			last, err = m.batch(c.Bucket([]byte(checkpointRecords)), c.Get([]byte(checkpointKey)), func(k, v []byte) error {
+				newElem := reflect.New(typ)
+				err := db.codec.Unmarshal(v, newElem.Interface())
 				if err != nil {
-					return err
+					return m.migrationError(bucketName, k, err)
 				}
 
-				b := tx.Bucket([]byte(bucketName))
-
-				// delete the old record
-				err = b.Delete(k)
+				records, err := m.transform(bucketName, newElem)
 				if err != nil {
-					tx.Rollback()
-					return err
+					return m.migrationError(bucketName, k, err)
+				}
+
+				saved++
+				for _, record := range records {
+					err = n.Save(record)
+					if err != nil {
+						return m.migrationError(bucketName, k, err)
+					}
 				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
 
-				// save the new record
-				err = b.Put(newKey, values[i])
+			if last == nil {
+				err = m.restoreSequence(tx, c, bucketName)
 				if err != nil {
-					tx.Rollback()
 					return err
 				}
 
-				tx.Commit()
-				break
+				return markDone(tx, name)
 			}
+
+			return c.Put([]byte(checkpointKey), last)
+		})
+		if err != nil {
+			return m.migrationError(bucketName, nil, err)
+		}
+
+		for i := 0; i < saved; i++ {
+			count++
+			m.observer.RecordProcessed(name, count)
+		}
+
+		if last == nil {
+			break
 		}
 	}
 
+	m.observer.BucketFinished(name, count)
 	return nil
 }
+
+// restoreSequence sets the sequence of the bucket saved in the checkpoint, if any.
+func (m *Migrator) restoreSequence(tx *bolt.Tx, c *bolt.Bucket, bucketName string) error {
+	raw := c.Get([]byte(checkpointSequence))
+	if raw == nil {
+		return nil
+	}
+
+	var seq uint64
+	err := binary.Read(bytes.NewReader(raw), binary.BigEndian, &seq)
+	if err != nil {
+		return err
+	}
+
+	bucket := m.bucket(tx, bucketName)
+	if bucket == nil {
+		bucket, err = m.parent(tx).CreateBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+	}
+
+	if bucket.Sequence() >= seq {
+		return nil
+	}
+	return bucket.SetSequence(seq)
+}
+
+// batch calls fn with at most batchSize records of the bucket, starting after the given key.
+// It returns the last key processed, or nil if there are no more records.
+func (m *Migrator) batch(b *bolt.Bucket, after []byte, fn func(k, v []byte) error) ([]byte, error) {
+	cursor := b.Cursor()
+	k, v := cursor.First()
+	if after != nil {
+		k, v = cursor.Seek(after)
+		if bytes.Equal(k, after) {
+			k, v = cursor.Next()
+		}
+	}
+
+	var last []byte
+	for i := 0; k != nil && i < m.batchSize; k, v = cursor.Next() {
+		if v == nil {
+			continue
+		}
+
+		err := m.ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		err = fn(k, v)
+		if err != nil {
+			return nil, err
+		}
+
+		last = k
+		i++
+	}
+
+	if last == nil {
+		return nil, nil
+	}
+
+	return append([]byte(nil), last...), nil
+}
+
+// runSet converts the keys of each bucket in a single transaction.
+func (m *Migrator) runSet(db *DB, kvKeys map[string][]interface{}) error {
+	names := make([]string, 0, len(kvKeys)+len(m.keyFuncs))
+	for bucketName := range kvKeys {
+		names = append(names, bucketName)
+	}
+	for bucketName := range m.keyFuncs {
+		if _, ok := kvKeys[bucketName]; !ok {
+			names = append(names, bucketName)
+		}
+	}
+	sort.Strings(names)
+
+	for _, bucketName := range names {
+		instances := kvKeys[bucketName]
+		name := m.name(bucketName)
+		err := db.Bolt.Update(func(tx *bolt.Tx) error {
+			done, err := isDone(tx, name)
+			if err != nil || done {
+				return err
+			}
+
+			m.observer.BucketStarted(name)
+
+			count, err := m.convertKeys(tx, bucketName, instances)
+			if err != nil {
+				return err
+			}
+
+			m.observer.BucketFinished(name, count)
+			return markDone(tx, name)
+		})
+		if err != nil {
+			return m.migrationError(bucketName, nil, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) convertKeys(tx *bolt.Tx, bucketName string, instances []interface{}) (int, error) {
+	b := m.bucket(tx, bucketName)
+	if b == nil {
+		return 0, nil
+	}
+
+	// fetch all keys and values from the bucket
+	var keys [][]byte
+	var values [][]byte
+	err := b.ForEach(func(k []byte, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+		values = append(values, append([]byte(nil), v...))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, k := range keys {
+		err = m.ctx.Err()
+		if err != nil {
+			return 0, err
+		}
+
+		// find the right instance
+		key, ok := m.matchKey(bucketName, k, instances)
+		if !ok {
+			m.observer.KeySkipped(m.name(bucketName), k)
+			continue
+		}
+
+		// create new key
+		newKey, err := toBytes(key, m.codec)
+		if err != nil {
+			return 0, m.migrationError(bucketName, k, err)
+		}
+
+		// delete the old record
+		err = b.Delete(k)
+		if err != nil {
+			return 0, m.migrationError(bucketName, k, err)
+		}
+
+		// save the new record
+		err = b.Put(newKey, values[i])
+		if err != nil {
+			return 0, m.migrationError(bucketName, k, err)
+		}
+
+		m.observer.RecordProcessed(m.name(bucketName), i+1)
+	}
+
+	return len(keys), nil
+}
+
+// matchKey decodes a key using the function registered for the bucket, if any,
+// or the given instances.
+func (m *Migrator) matchKey(bucketName string, k []byte, instances []interface{}) (interface{}, bool) {
+	fn, ok := m.keyFuncs[bucketName]
+	if !ok {
+		return m.MatchKey(k, instances)
+	}
+
+	key, err := fn(k)
+	if err != nil || key == nil {
+		return nil, false
+	}
+
+	return reflect.Indirect(reflect.ValueOf(key)).Interface(), true
+}
+
+// MatchKey decodes a key created by Storm v0.4 using the first of the given instances
+// that matches. It returns false if none of them can decode the key.
+func (m *Migrator) MatchKey(k []byte, instances []interface{}) (interface{}, bool) {
+	for _, inst := range instances {
+		r := reflect.Indirect(reflect.ValueOf(inst))
+		t := r.Type()
+		switch {
+		case t.Kind() == reflect.String:
+			r.SetString(string(k))
+		case t.AssignableTo(reflect.TypeOf([]byte{})):
+			r.SetBytes(k)
+		default:
+			err := m.codec.Unmarshal(k, inst)
+			if err != nil {
+				// if it doesn't match, try another
+				continue
+			}
+		}
+
+		return r.Interface(), true
+	}
+
+	return nil, false
+}
@@ -1,6 +1,7 @@
 package storm
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -8,6 +9,7 @@ import (
 
 	stormv04 "github.com/asdine/storm-migrator/v0.4"
 	"github.com/asdine/storm-migrator/v0.6/codec/json"
+	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/require"
 )
 
@@ -60,3 +62,90 @@ func TestMigrator(t *testing.T) {
 	require.NoError(t, err)
 
 }
+
+func TestMigratorBatchSize(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "storm")
+	defer os.RemoveAll(dir)
+
+	dbv04, err := stormv04.Open(filepath.Join(dir, "my.db"))
+	require.NoError(t, err)
+	defer dbv04.Close()
+
+	for i := 0; i < 25; i++ {
+		err = dbv04.Save(&User{ID: i + 1, Name: "John", Slug: fmt.Sprintf("john%d", i)})
+		require.NoError(t, err)
+	}
+
+	var counts []int
+	o := observer{processed: func(count int) { counts = append(counts, count) }}
+	m := NewMigrator(dbv04.Bolt, json.Codec, BatchSize(10), Observe(&o))
+	err = m.Run([]interface{}{new(User)}, nil)
+	require.NoError(t, err)
+	require.Len(t, counts, 25)
+
+	dbv05, err := Open("", UseDB(dbv04.Bolt))
+	require.NoError(t, err)
+
+	var users []User
+	err = dbv05.Find("Name", "John", &users)
+	require.NoError(t, err)
+	require.Len(t, users, 25)
+
+	var u User
+	err = dbv05.One("Slug", "john24", &u)
+	require.NoError(t, err)
+	require.Equal(t, 25, u.ID)
+
+	// the checkpoint is removed
+	err = dbv04.Bolt.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte(dbinfo)).Bucket([]byte(checkpointBucket)))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestMigratorSequence(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "storm")
+	defer os.RemoveAll(dir)
+
+	dbv04, err := stormv04.Open(filepath.Join(dir, "my.db"), stormv04.AutoIncrement())
+	require.NoError(t, err)
+	defer dbv04.Close()
+
+	for i := 0; i < 10; i++ {
+		err = dbv04.Save(&User{Name: "John", Slug: fmt.Sprintf("john%d", i)})
+		require.NoError(t, err)
+	}
+
+	// the last record is removed, its id must not be reused
+	err = dbv04.DeleteStruct(&User{ID: 10})
+	require.NoError(t, err)
+
+	m := NewMigrator(dbv04.Bolt, json.Codec, BatchSize(3))
+	err = m.Run([]interface{}{new(User)}, nil)
+	require.NoError(t, err)
+
+	dbv05, err := Open("", UseDB(dbv04.Bolt), AutoIncrement())
+	require.NoError(t, err)
+
+	u := User{Name: "John", Slug: "john10"}
+	err = dbv05.Save(&u)
+	require.NoError(t, err)
+	require.Equal(t, 11, u.ID)
+
+	// the saved sequence is removed with the checkpoint
+	err = dbv04.Bolt.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte(dbinfo)).Bucket([]byte(checkpointBucket)))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+type observer struct {
+	nopObserver
+	processed func(count int)
+}
+
+func (o *observer) RecordProcessed(bucket string, count int) {
+	o.processed(count)
+}
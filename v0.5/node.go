@@ -62,7 +62,8 @@ type node struct {
 // From returns a new Storm Node with a new bucket root below the current.
 // All DB operations on the new node will be executed relative to this bucket.
 func (n node) From(addend ...string) Node {
-	n.rootBucket = append(n.rootBucket, addend...)
+	// copy the root so that the nodes created from the same parent don't share it
+	n.rootBucket = append(append([]string(nil), n.rootBucket...), addend...)
 	return &n
 }
 
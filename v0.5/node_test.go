@@ -24,6 +24,13 @@ func TestNode(t *testing.T) {
 	node2, ok := n2.(*node)
 	assert.True(t, ok)
 	assert.Equal(t, []string{"b", "c", "d", "e"}, node2.rootBucket)
+
+	// the nodes created from the same parent don't share their root
+	n3 := n1.From("d")
+	n4 := n3.From("x")
+	n5 := n3.From("y")
+	assert.Equal(t, []string{"b", "c", "d", "x"}, n4.(*node).rootBucket)
+	assert.Equal(t, []string{"b", "c", "d", "y"}, n5.(*node).rootBucket)
 }
 
 func TestNodeWithTransaction(t *testing.T) {
@@ -0,0 +1,72 @@
+package storm
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Transform option registers a function called with every record of the given bucket before it is saved back.
+// The function returns the record to save, which can be of another type, a slice to save several records,
+// or nil to drop the record.
+func Transform(bucketName string, fn func(record reflect.Value) (interface{}, error)) func(*Migrator) {
+	return func(m *Migrator) {
+		if m.transforms == nil {
+			m.transforms = make(map[string]func(reflect.Value) (interface{}, error))
+		}
+		m.transforms[bucketName] = fn
+	}
+}
+
+// transform applies the function registered for the bucket to the record, if any,
+// and returns the records to save.
+func (m *Migrator) transform(bucketName string, record reflect.Value) ([]interface{}, error) {
+	fn, ok := m.transforms[bucketName]
+	if !ok {
+		return []interface{}{record.Interface()}, nil
+	}
+
+	v, err := fn(record.Elem())
+	if err != nil {
+		return nil, fmt.Errorf("record %v: %w", recordID(record), err)
+	}
+
+	return toRecords(v), nil
+}
+
+// recordID returns the id of the record, or nil if it can't be found.
+func recordID(record reflect.Value) interface{} {
+	info, err := extract(&record)
+	if err != nil {
+		return nil
+	}
+
+	return info.ID.Value.Interface()
+}
+
+// toRecords turns the value returned by a transform function into a list of records.
+func toRecords(v interface{}) []interface{} {
+	if v == nil {
+		return nil
+	}
+
+	ref := reflect.ValueOf(v)
+	switch ref.Kind() {
+	case reflect.Slice, reflect.Array:
+		var list []interface{}
+		for i := 0; i < ref.Len(); i++ {
+			list = append(list, toRecords(ref.Index(i).Interface())...)
+		}
+		return list
+	case reflect.Ptr:
+		if ref.IsNil() {
+			return nil
+		}
+	case reflect.Struct:
+		// records are saved using a pointer
+		ptr := reflect.New(ref.Type())
+		ptr.Elem().Set(ref)
+		return []interface{}{ptr.Interface()}
+	}
+
+	return []interface{}{v}
+}
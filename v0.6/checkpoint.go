@@ -0,0 +1,64 @@
+package storm
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// The checkpoint of a migration is stored in a bucket nested in the dbinfo bucket
+// so an interrupted migration can be resumed.
+const (
+	checkpointBucket = "checkpoint"
+	// buckets that are fully migrated
+	checkpointDone = "done"
+)
+
+// checkpoint returns the checkpoint bucket, creating it if needed.
+func checkpoint(tx *bolt.Tx) (*bolt.Bucket, error) {
+	info, err := tx.CreateBucketIfNotExists([]byte(dbinfo))
+	if err != nil {
+		return nil, err
+	}
+
+	return info.CreateBucketIfNotExists([]byte(checkpointBucket))
+}
+
+// isDone reports whether the given bucket was already migrated.
+func isDone(tx *bolt.Tx, bucketName string) (bool, error) {
+	c, err := checkpoint(tx)
+	if err != nil {
+		return false, err
+	}
+
+	done := c.Bucket([]byte(checkpointDone))
+	return done != nil && done.Get([]byte(bucketName)) != nil, nil
+}
+
+// markDone records that the given bucket is migrated.
+func markDone(tx *bolt.Tx, bucketName string) error {
+	c, err := checkpoint(tx)
+	if err != nil {
+		return err
+	}
+
+	done, err := c.CreateBucketIfNotExists([]byte(checkpointDone))
+	if err != nil {
+		return err
+	}
+
+	return done.Put([]byte(bucketName), []byte{1})
+}
+
+// clearCheckpoint removes the checkpoint once the migration is over.
+func clearCheckpoint(tx *bolt.Tx) error {
+	info := tx.Bucket([]byte(dbinfo))
+	if info == nil {
+		return nil
+	}
+
+	err := info.DeleteBucket([]byte(checkpointBucket))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+
+	return nil
+}
@@ -1,6 +1,9 @@
 package storm
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 // Errors
 var (
@@ -52,3 +55,24 @@ var (
 	// ErrDifferentCodec is returned when using a codec different than the first codec used with the bucket.
 	ErrDifferentCodec = errors.New("the selected codec is incompatible with this bucket")
 )
+
+// MigrationError is returned by the Migrator when a bucket or one of its records can't be migrated.
+type MigrationError struct {
+	// Path of the bucket, the elements being separated by slashes
+	Bucket string
+	// Raw key of the record, nil if the error concerns the whole bucket
+	Key []byte
+	Err error
+}
+
+func (e *MigrationError) Error() string {
+	if e.Key == nil {
+		return fmt.Sprintf("bucket %s: %v", e.Bucket, e.Err)
+	}
+
+	return fmt.Sprintf("bucket %s, key %q: %v", e.Bucket, e.Key, e.Err)
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
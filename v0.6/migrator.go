@@ -1,24 +1,95 @@
 package storm
 
 import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+
 	"github.com/asdine/storm-migrator/v0.6/codec"
 	"github.com/boltdb/bolt"
 )
 
 // NewMigrator instantiates a new Migrator
-func NewMigrator(db *bolt.DB, codec codec.MarshalUnmarshaler) *Migrator {
-	return &Migrator{boltDB: db, codec: codec}
+func NewMigrator(db *bolt.DB, codec codec.MarshalUnmarshaler, options ...func(*Migrator)) *Migrator {
+	m := Migrator{boltDB: db, codec: codec, observer: nopObserver{}, ctx: context.Background()}
+	for _, option := range options {
+		option(&m)
+	}
+	return &m
 }
 
-// Migrator migrates the given database to v0.5
+// Migrator migrates the given database to v0.6
 type Migrator struct {
-	boltDB *bolt.DB
-	codec  codec.MarshalUnmarshaler
+	boltDB   *bolt.DB
+	codec    codec.MarshalUnmarshaler
+	observer Observer
+	codecs   map[string]codec.MarshalUnmarshaler
+	// functions applied to the records before saving them, by bucket name
+	transforms map[string]func(reflect.Value) (interface{}, error)
+	// path of the node containing the migrated buckets, empty for the top level
+	root []string
+	// checked between records, the migration stops once it is done
+	ctx context.Context
+	// set if the database uses AutoIncrement, the integer ids are then incremented without the increment tag
+	autoIncrement bool
+}
+
+// Observer is notified of the progress of the migration.
+type Observer interface {
+	// BucketStarted is called before migrating a bucket
+	BucketStarted(bucket string)
+	// RecordProcessed is called every time a record is migrated, with the number of records migrated so far
+	RecordProcessed(bucket string, count int)
+	// BucketFinished is called once a bucket is migrated, with the total number of records
+	BucketFinished(bucket string, count int)
+}
+
+// Observe option registers an Observer notified of the progress of the migration.
+func Observe(o Observer) func(*Migrator) {
+	return func(m *Migrator) {
+		m.observer = o
+	}
+}
+
+// Context option sets a context checked between the records. Once it is done, the transaction of the current bucket
+// is rolled back and Run returns its error. The buckets reindexed before are kept, running the migration again resumes it.
+func Context(ctx context.Context) func(*Migrator) {
+	return func(m *Migrator) {
+		m.ctx = ctx
+	}
+}
+
+// BucketCodec option sets the codec used by the records of the given top level bucket,
+// instead of the one given to NewMigrator. The buckets migrated with RunAt always use the codec given to NewMigrator.
+func BucketCodec(bucketName string, c codec.MarshalUnmarshaler) func(*Migrator) {
+	return func(m *Migrator) {
+		if m.codecs == nil {
+			m.codecs = make(map[string]codec.MarshalUnmarshaler)
+		}
+		m.codecs[bucketName] = c
+	}
+}
+
+// MigratorAutoIncrement option tells that the database is opened with the AutoIncrement option, so that the counters
+// of the integer ids are seeded even if they don't have the increment tag. The ids of the buckets
+// whose sequence was used by Storm v0.5 to increment them are always seeded.
+func MigratorAutoIncrement() func(*Migrator) {
+	return func(m *Migrator) {
+		m.autoIncrement = true
+	}
 }
 
-// Run the migration
+type nopObserver struct{}
+
+func (nopObserver) BucketStarted(string)        {}
+func (nopObserver) RecordProcessed(string, int) {}
+func (nopObserver) BucketFinished(string, int)  {}
+
+// Run the migration. Each bucket is reindexed in a single transaction,
+// running the migration again on an interrupted database skips the buckets already reindexed.
 func (m *Migrator) Run(instances []interface{}, kvKeys map[string][]interface{}) error {
-	db, err := Open("", UseDB(m.boltDB))
+	db, err := Open("", UseDB(m.boltDB), Codec(m.codec))
 	if err != nil {
 		return err
 	}
@@ -28,14 +99,191 @@ func (m *Migrator) Run(instances []interface{}, kvKeys map[string][]interface{})
 		return err
 	}
 
-	// set new version
-	return db.Set(dbinfo, "version", Version)
+	return db.Bolt.Update(func(tx *bolt.Tx) error {
+		err := clearCheckpoint(tx)
+		if err != nil {
+			return err
+		}
+
+		// set new version
+		return db.WithTransaction(tx).Set(dbinfo, "version", Version)
+	})
+}
+
+// RunAt migrates the buckets nested under the node at the given path, created using the Root or From methods.
+// It must be called before Run, which bumps the version of the database.
+func (m *Migrator) RunAt(path []string, instances []interface{}, kvKeys map[string][]interface{}) error {
+	n := *m
+	n.root = append([]string(nil), path...)
+
+	db, err := Open("", UseDB(m.boltDB), Codec(m.codec), Root(n.root...))
+	if err != nil {
+		return err
+	}
+
+	return n.runSaved(db, instances)
+}
+
+// migrationError adds the bucket and the key, if any, to an error that doesn't already have them.
+func (m *Migrator) migrationError(bucketName string, k []byte, err error) error {
+	var merr *MigrationError
+	if errors.As(err, &merr) {
+		return err
+	}
+
+	if k != nil {
+		k = append([]byte(nil), k...)
+	}
+	return &MigrationError{Bucket: m.name(bucketName), Key: k, Err: err}
+}
+
+// name returns the path of the bucket, used to identify it in the checkpoint and the notifications.
+func (m *Migrator) name(bucketName string) string {
+	return strings.Join(append(append([]string(nil), m.root...), bucketName), "/")
 }
 
 func (m *Migrator) runSaved(db *DB, instances []interface{}) error {
 	for _, inst := range instances {
+		err := m.ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		ref := reflect.ValueOf(inst)
+		if !ref.IsValid() || ref.Kind() != reflect.Ptr || ref.Elem().Kind() != reflect.Struct {
+			return ErrStructPtrNeeded
+		}
+
+		cfg, err := extract(&ref)
+		if err != nil {
+			return err
+		}
+
+		bdb, err := m.dbFor(db, cfg.Name)
+		if err != nil {
+			return err
+		}
+
+		name := m.name(cfg.Name)
+
 		// reindex
-		err := db.ReIndex(inst)
+		err = bdb.root.readWriteTx(func(tx *bolt.Tx) error {
+			done, err := isDone(tx, name)
+			if err != nil || done {
+				return err
+			}
+
+			if bdb.root.GetBucket(tx, cfg.Name) == nil {
+				return markDone(tx, name)
+			}
+
+			var count int
+			progress := func(i int) error {
+				count = i
+				m.observer.RecordProcessed(name, i)
+				return m.ctx.Err()
+			}
+
+			m.observer.BucketStarted(name)
+			if _, ok := m.transforms[cfg.Name]; ok {
+				err = m.resave(bdb, tx, inst, cfg, progress)
+			} else {
+				err = bdb.root.reIndex(tx, inst, cfg, progress)
+			}
+			if err != nil {
+				return err
+			}
+
+			err = bdb.seedCounters(tx, inst, cfg, m.autoIncrement)
+			if err != nil {
+				return err
+			}
+			m.observer.BucketFinished(name, count)
+
+			return markDone(tx, name)
+		})
+		if err != nil {
+			return m.migrationError(cfg.Name, nil, err)
+		}
+	}
+
+	return nil
+}
+
+// seedCounters sets the increment counters of the bucket metadata to the highest value used by the records,
+// so that the next increments don't collide with them. Only the fields with the increment tag are incremented,
+// and the integer ids if the database uses AutoIncrement. Storm v0.5 used the sequence of the bucket to increment the ids.
+func (s *DB) seedCounters(tx *bolt.Tx, inst interface{}, cfg *structConfig, autoIncrement bool) error {
+	bucket := s.root.GetBucket(tx, cfg.Name)
+	if bucket == nil {
+		return nil
+	}
+
+	counters := make(map[string]int64)
+	for name, field := range cfg.Fields {
+		if field.IsInteger && field.Increment {
+			counters[name] = 0
+		}
+	}
+
+	if id := cfg.ID; id != nil && id.IsInteger && (id.Increment || autoIncrement || bucket.Sequence() > 0) {
+		counters[id.Name] = int64(bucket.Sequence())
+	}
+	if len(counters) == 0 {
+		return nil
+	}
+
+	typ := reflect.Indirect(reflect.ValueOf(inst)).Type()
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		record := reflect.New(typ)
+		err := s.codec.Unmarshal(v, record.Interface())
+		if err != nil {
+			return err
+		}
+
+		for name, highest := range counters {
+			if n := toInt64(record.Elem().FieldByName(name)); n > highest {
+				counters[name] = n
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	meta, err := newMeta(bucket, s.root)
+	if err != nil {
+		return err
+	}
+
+	for name, highest := range counters {
+		// the first increment uses the start value if there is no counter
+		if highest < cfg.Fields[name].IncrementStart {
+			continue
+		}
+
+		key := []byte(name + "counter")
+		if raw := meta.bucket.Get(key); raw != nil {
+			counter, err := numberfromb(raw)
+			if err != nil {
+				return err
+			}
+			if counter >= highest {
+				continue
+			}
+		}
+
+		raw, err := numbertob(highest)
+		if err != nil {
+			return err
+		}
+
+		err = meta.bucket.Put(key, raw)
 		if err != nil {
 			return err
 		}
@@ -43,3 +291,26 @@ func (m *Migrator) runSaved(db *DB, instances []interface{}) error {
 
 	return nil
 }
+
+// toInt64 returns the value of an integer field.
+func toInt64(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	}
+
+	return 0
+}
+
+// dbFor returns the database to use with the given bucket,
+// opened with the codec registered for the bucket if it is a top level one.
+func (m *Migrator) dbFor(db *DB, bucketName string) (*DB, error) {
+	c, ok := m.codecs[bucketName]
+	if !ok || len(m.root) > 0 {
+		return db, nil
+	}
+
+	return Open("", UseDB(m.boltDB), Codec(c), Root(m.root...))
+}
@@ -9,6 +9,7 @@ import (
 
 	stormv05 "github.com/asdine/storm-migrator/v0.5"
 	"github.com/asdine/storm-migrator/v0.6/codec/json"
+	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/require"
 )
 
@@ -49,3 +50,119 @@ func TestMigrator(t *testing.T) {
 		require.Equal(t, i+1, u.ID)
 	}
 }
+
+func TestMigratorCounters(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "storm")
+	defer os.RemoveAll(dir)
+
+	dbv05, err := stormv05.Open(filepath.Join(dir, "my.db"), stormv05.AutoIncrement())
+	require.NoError(t, err)
+	defer dbv05.Close()
+
+	{
+		// v0.5 doesn't know about the increment tag
+		type Item struct {
+			ID     int `storm:"id"`
+			Number int
+			Name   string
+		}
+
+		for i := 0; i < 5; i++ {
+			err = dbv05.Save(&Item{Number: i * 3, Name: "John"})
+			require.NoError(t, err)
+		}
+		err = dbv05.Save(&Item{ID: 20, Number: 42})
+		require.NoError(t, err)
+
+		type Other struct {
+			ID     uint64
+			Number int
+		}
+
+		err = dbv05.Save(&Other{ID: 5, Number: 4})
+		require.NoError(t, err)
+	}
+
+	type Item struct {
+		ID     int `storm:"id,increment"`
+		Number int `storm:"increment=10"`
+		Name   string
+	}
+
+	type Other struct {
+		ID     uint64 `storm:"id,increment=100"`
+		Number int    `storm:"increment=100"`
+	}
+
+	m := NewMigrator(dbv05.Bolt, json.Codec)
+	err = m.Run([]interface{}{new(Item), new(Other)}, nil)
+	require.NoError(t, err)
+
+	dbv06, err := Open("", UseDB(dbv05.Bolt))
+	require.NoError(t, err)
+
+	item := Item{Name: "Jack"}
+	err = dbv06.Save(&item)
+	require.NoError(t, err)
+	require.Equal(t, 21, item.ID)
+	require.Equal(t, 43, item.Number)
+
+	var count int
+	count, err = dbv06.Count(new(Item))
+	require.NoError(t, err)
+	require.Equal(t, 7, count)
+
+	// the counters are not seeded below the start value
+	other := Other{}
+	err = dbv06.Save(&other)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), other.ID)
+	require.Equal(t, 100, other.Number)
+}
+
+func TestMigratorCountersAutoIncrement(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "storm")
+	defer os.RemoveAll(dir)
+
+	dbv05, err := stormv05.Open(filepath.Join(dir, "my.db"))
+	require.NoError(t, err)
+	defer dbv05.Close()
+
+	type Plain struct {
+		ID   int
+		Name string
+	}
+
+	for i := 0; i < 5; i++ {
+		err = dbv05.Save(&Plain{ID: i + 1, Name: "John"})
+		require.NoError(t, err)
+	}
+
+	counter := func() []byte {
+		var raw []byte
+		dbv05.Bolt.View(func(tx *bolt.Tx) error {
+			if meta := tx.Bucket([]byte("Plain")).Bucket([]byte(metadataBucket)); meta != nil {
+				raw = meta.Get([]byte("IDcounter"))
+			}
+			return nil
+		})
+		return raw
+	}
+
+	// the ids are not incremented without the increment tag or AutoIncrement
+	err = NewMigrator(dbv05.Bolt, json.Codec).Run([]interface{}{new(Plain)}, nil)
+	require.NoError(t, err)
+	require.Nil(t, counter())
+
+	err = NewMigrator(dbv05.Bolt, json.Codec, MigratorAutoIncrement()).Run([]interface{}{new(Plain)}, nil)
+	require.NoError(t, err)
+	require.NotNil(t, counter())
+
+	dbv06, err := Open("", UseDB(dbv05.Bolt), AutoIncrement())
+	require.NoError(t, err)
+
+	p := Plain{Name: "Jack"}
+	err = dbv06.Save(&p)
+	require.NoError(t, err)
+	require.Equal(t, 6, p.ID)
+}
@@ -97,11 +97,13 @@ func (n *node) ReIndex(data interface{}) error {
 	}
 
 	return n.readWriteTx(func(tx *bolt.Tx) error {
-		return n.reIndex(tx, data, cfg)
+		return n.reIndex(tx, data, cfg, nil)
 	})
 }
 
-func (n *node) reIndex(tx *bolt.Tx, data interface{}, cfg *structConfig) error {
+// reIndex rebuilds the indexes of the bucket. If progress is not nil, it is called
+// with the number of records reindexed so far, an error stops the reindexing.
+func (n *node) reIndex(tx *bolt.Tx, data interface{}, cfg *structConfig, progress func(int) error) error {
 	root := n.WithTransaction(tx)
 	nodes := root.From(cfg.Name).PrefixScan(indexPrefix)
 	bucket := root.GetBucket(tx, cfg.Name)
@@ -133,6 +135,13 @@ func (n *node) reIndex(tx *bolt.Tx, data interface{}, cfg *structConfig) error {
 		if err != nil {
 			return err
 		}
+
+		if progress != nil {
+			err = progress(i + 1)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -0,0 +1,142 @@
+package storm
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/boltdb/bolt"
+)
+
+// Transform option registers a function called with every record of the given bucket before it is saved back.
+// The function returns the record to save, which can be of another type, a slice to save several records,
+// or nil to drop the record.
+func Transform(bucketName string, fn func(record reflect.Value) (interface{}, error)) func(*Migrator) {
+	return func(m *Migrator) {
+		if m.transforms == nil {
+			m.transforms = make(map[string]func(reflect.Value) (interface{}, error))
+		}
+		m.transforms[bucketName] = fn
+	}
+}
+
+// transform applies the function registered for the bucket to the record, if any,
+// and returns the records to save.
+func (m *Migrator) transform(bucketName string, record reflect.Value) ([]interface{}, error) {
+	fn, ok := m.transforms[bucketName]
+	if !ok {
+		return []interface{}{record.Interface()}, nil
+	}
+
+	v, err := fn(record.Elem())
+	if err != nil {
+		return nil, fmt.Errorf("record %v: %w", recordID(record), err)
+	}
+
+	return toRecords(v), nil
+}
+
+// recordID returns the id of the record, or nil if it can't be found.
+func recordID(record reflect.Value) interface{} {
+	cfg, err := extract(&record)
+	if err != nil {
+		return nil
+	}
+
+	return cfg.ID.Value.Interface()
+}
+
+// toRecords turns the value returned by a transform function into a list of records.
+func toRecords(v interface{}) []interface{} {
+	if v == nil {
+		return nil
+	}
+
+	ref := reflect.ValueOf(v)
+	switch ref.Kind() {
+	case reflect.Slice, reflect.Array:
+		var list []interface{}
+		for i := 0; i < ref.Len(); i++ {
+			list = append(list, toRecords(ref.Index(i).Interface())...)
+		}
+		return list
+	case reflect.Ptr:
+		if ref.IsNil() {
+			return nil
+		}
+	case reflect.Struct:
+		// records are saved using a pointer
+		ptr := reflect.New(ref.Type())
+		ptr.Elem().Set(ref)
+		return []interface{}{ptr.Interface()}
+	}
+
+	return []interface{}{v}
+}
+
+// resave decodes the records of the bucket and removes them along with the indexes,
+// then saves the records returned by the transform function.
+func (m *Migrator) resave(db *DB, tx *bolt.Tx, inst interface{}, cfg *structConfig, progress func(int) error) error {
+	bucket := db.root.GetBucket(tx, cfg.Name)
+	typ := reflect.Indirect(reflect.ValueOf(inst)).Type()
+
+	var keys, indexes [][]byte
+	var records []reflect.Value
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			if bytes.HasPrefix(k, []byte(indexPrefix)) {
+				indexes = append(indexes, append([]byte(nil), k...))
+			}
+			return nil
+		}
+
+		record := reflect.New(typ)
+		err := db.codec.Unmarshal(v, record.Interface())
+		if err != nil {
+			return m.migrationError(cfg.Name, k, err)
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range indexes {
+		err = bucket.DeleteBucket(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, k := range keys {
+		err = bucket.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	n := db.root.WithTransaction(tx)
+	for i, record := range records {
+		list, err := m.transform(cfg.Name, record)
+		if err != nil {
+			return m.migrationError(cfg.Name, keys[i], err)
+		}
+
+		for _, r := range list {
+			err = n.Save(r)
+			if err != nil {
+				return m.migrationError(cfg.Name, keys[i], err)
+			}
+		}
+
+		err = progress(i + 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
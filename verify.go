@@ -0,0 +1,629 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// VerifyReport lists the differences found between the source and the destination databases.
+type VerifyReport struct {
+	Buckets []BucketDiff `json:"buckets"`
+	// Top level buckets of the source that were not registered, their content is not compared
+	Unverified []string `json:"unverified,omitempty"`
+}
+
+// OK reports whether no difference was found.
+func (r *VerifyReport) OK() bool {
+	for i := range r.Buckets {
+		if !r.Buckets[i].OK() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String returns a printable version of the report.
+func (r *VerifyReport) String() string {
+	var buf bytes.Buffer
+
+	for _, d := range r.Buckets {
+		fmt.Fprintf(&buf, "%s (%s): %d records in source, %d in destination\n", d.Name, d.Kind, d.SourceCount, d.DestinationCount)
+		writeIDs(&buf, "missing", d.Missing)
+		writeIDs(&buf, "different", d.Different)
+		writeIDs(&buf, "unexpected", d.Unexpected)
+		writeIDs(&buf, "dangling index entries", d.DanglingIndexes)
+		writeIDs(&buf, "unindexed", d.Unindexed)
+	}
+
+	if len(r.Unverified) > 0 {
+		fmt.Fprintf(&buf, "unverified: %s\n", strings.Join(r.Unverified, ", "))
+	}
+
+	return buf.String()
+}
+
+func writeIDs(buf *bytes.Buffer, label string, ids []string) {
+	if len(ids) > 0 {
+		fmt.Fprintf(buf, "  %s: %s\n", label, strings.Join(ids, ", "))
+	}
+}
+
+// BucketDiff lists the records or keys of a bucket that failed the verification.
+type BucketDiff struct {
+	Name string `json:"name"`
+	// TypeBucket or KVBucket
+	Kind             string `json:"kind"`
+	SourceCount      int    `json:"source_count"`
+	DestinationCount int    `json:"destination_count"`
+	// Records or keys of the source that are not in the destination
+	Missing []string `json:"missing,omitempty"`
+	// Records or keys whose decoded values are different
+	Different []string `json:"different,omitempty"`
+	// Records or keys of the destination that are not in the source
+	Unexpected []string `json:"unexpected,omitempty"`
+	// Index entries that point to a record that doesn't exist
+	DanglingIndexes []string `json:"dangling_indexes,omitempty"`
+	// Records missing from one of their indexes
+	Unindexed []string `json:"unindexed,omitempty"`
+}
+
+// OK reports whether no difference was found.
+func (d *BucketDiff) OK() bool {
+	return d.SourceCount == d.DestinationCount &&
+		len(d.Missing) == 0 &&
+		len(d.Different) == 0 &&
+		len(d.Unexpected) == 0 &&
+		len(d.DanglingIndexes) == 0 &&
+		len(d.Unindexed) == 0
+}
+
+// VerificationError is returned by Run when the Verify option is used and differences are found.
+type VerificationError struct {
+	Report *VerifyReport
+}
+
+func (e *VerificationError) Error() string {
+	return "verification failed:\n" + e.Report.String()
+}
+
+// Verify compares the content of the source database with the given migrated database.
+// Both databases are opened in read-only mode using the Storm version they were created with.
+// For every registered type, records and indexes are compared.
+// For every registered key value bucket, keys and values are compared.
+// The buckets registered with AddBucketsAt and AddKVAt are compared as well and reported with their full path.
+// The top level buckets that were not registered are listed as unverified.
+// The records of the source are compared once the transform functions are applied to them,
+// the functions must then return the same records every time they are called.
+func (m *Migrator) Verify(dst string) (*VerifyReport, error) {
+	src, err := openSource(m.path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	b, err := bolt.Open(dst, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	return m.verify(src, b)
+}
+
+func (m *Migrator) verify(src, dst *bolt.DB) (*VerifyReport, error) {
+	srcVersion, err := m.getVersion(src)
+	if err != nil {
+		return nil, err
+	}
+
+	dstVersion, err := m.getVersion(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	var r VerifyReport
+
+	root := Node{Instances: m.instances}
+	nodes, err := m.expandNodes(src)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range append([]Node{root}, nodes...) {
+		diffs, err := m.verifyTypes(src, dst, srcVersion, dstVersion, n.Path, n.Instances)
+		if err != nil {
+			return nil, err
+		}
+		r.Buckets = append(r.Buckets, diffs...)
+
+		names := make([]string, 0, len(n.KV))
+		for name := range n.KV {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			instances := n.KV[name]
+			d, err := m.verifyKV(src, srcVersion, dst, dstVersion, n.Path, name, func(version string, k []byte) (interface{}, bool) {
+				return decodeKey(version, k, instances, m.codecAt(n.Path, name))
+			})
+			if err != nil {
+				return nil, err
+			}
+			r.Buckets = append(r.Buckets, *d)
+		}
+	}
+
+	for _, name := range m.kvBuckets() {
+		name := name
+		d, err := m.verifyKV(src, srcVersion, dst, dstVersion, nil, name, func(version string, k []byte) (interface{}, bool) {
+			return m.decodeKVKey(version, name, k)
+		})
+		if err != nil {
+			return nil, err
+		}
+		r.Buckets = append(r.Buckets, *d)
+	}
+
+	err = src.View(func(tx *bolt.Tx) error {
+		for name := range m.unregistered(tx) {
+			r.Unverified = append(r.Unverified, name)
+		}
+		return nil
+	})
+	sort.Strings(r.Unverified)
+
+	return &r, err
+}
+
+// pathName returns the name of a bucket nested under the given path, as reported in the events.
+func pathName(path []string, name string) string {
+	return strings.Join(append(path[:len(path):len(path)], name), "/")
+}
+
+// sourceNameAt returns the name of the bucket nested under the given path in the source database.
+// Only the top level buckets are renamed.
+func (m *Migrator) sourceNameAt(path []string, name string) string {
+	if len(path) == 0 {
+		return m.sourceName(name)
+	}
+
+	return name
+}
+
+// bucketAt returns the bucket nested under the given path, or nil if it doesn't exist.
+func bucketAt(tx *bolt.Tx, path []string, name string) *bolt.Bucket {
+	if len(path) == 0 {
+		return tx.Bucket([]byte(name))
+	}
+
+	b := tx.Bucket([]byte(path[0]))
+	for _, elem := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket([]byte(elem))
+	}
+	if b == nil {
+		return nil
+	}
+
+	return b.Bucket([]byte(name))
+}
+
+// verifyTypes compares the records of the given types, nested under the given path, one bucket at a time.
+// The records are read with a cursor and looked up in the other database by their key, so that only the keys
+// are kept in memory. The transform functions are applied to the records of the source, the records they return
+// are compared with the ones of the bucket of their own type.
+func (m *Migrator) verifyTypes(src, dst *bolt.DB, srcVersion, dstVersion string, path []string, instances []interface{}) ([]BucketDiff, error) {
+	diffs := make(map[string]*BucketDiff)
+	var transformed bool
+	for _, inst := range instances {
+		name := bucketName(inst)
+		diffs[name] = &BucketDiff{Name: pathName(path, name), Kind: TypeBucket}
+		if _, ok := m.transforms[name]; ok {
+			transformed = true
+		}
+	}
+
+	// with transforms, the records of a bucket can come from any other bucket:
+	// the keys of the expected records are collected to find the unexpected ones
+	var expected map[string]map[string]bool
+	if transformed {
+		expected = make(map[string]map[string]bool)
+		for name := range diffs {
+			expected[name] = make(map[string]bool)
+		}
+	}
+
+	err := src.View(func(srcTx *bolt.Tx) error {
+		return dst.View(func(dstTx *bolt.Tx) error {
+			for _, inst := range instances {
+				err := m.compareSource(srcTx, dstTx, dstVersion, path, inst, diffs, expected)
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, inst := range instances {
+				name := bucketName(inst)
+				err := m.compareDestination(srcTx, dstTx, srcVersion, path, inst, diffs[name], expected[name])
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]BucketDiff, 0, len(instances))
+	for _, inst := range instances {
+		d := diffs[bucketName(inst)]
+		sort.Strings(d.Missing)
+		sort.Strings(d.Different)
+		sort.Strings(d.Unexpected)
+		sort.Strings(d.DanglingIndexes)
+		sort.Strings(d.Unindexed)
+		list = append(list, *d)
+	}
+
+	return list, nil
+}
+
+// compareSource looks up every record of the source bucket of the type in the destination,
+// once transformed if a transform function was registered for the type.
+func (m *Migrator) compareSource(srcTx, dstTx *bolt.Tx, dstVersion string, path []string, inst interface{},
+	diffs map[string]*BucketDiff, expected map[string]map[string]bool) error {
+	typ := reflect.Indirect(reflect.ValueOf(inst)).Type()
+	name := typ.Name()
+
+	bucket := bucketAt(srcTx, path, m.sourceNameAt(path, name))
+	if bucket == nil {
+		return nil
+	}
+
+	c := m.codecAt(path, name)
+	fn := m.transforms[name]
+
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		record := reflect.New(typ)
+		err := c.Unmarshal(v, record.Interface())
+		if err != nil {
+			return &Error{Bucket: pathName(path, name), Key: append([]byte(nil), k...), Type: typ, Err: err}
+		}
+
+		records := []interface{}{record.Interface()}
+		if fn != nil {
+			out, err := fn(record.Elem())
+			if err != nil {
+				id, _ := inspectRecord(record)
+				return &Error{Bucket: pathName(path, name), Type: typ, Err: fmt.Errorf("record %v: %w", id.Interface(), err)}
+			}
+			records = transformedRecords(out)
+		}
+
+		for _, r := range records {
+			err = m.lookupRecord(dstTx, dstVersion, path, reflect.Indirect(reflect.ValueOf(r)), diffs, expected)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// lookupRecord compares a record expected in the destination with the one stored with the same id.
+func (m *Migrator) lookupRecord(dstTx *bolt.Tx, dstVersion string, path []string, record reflect.Value,
+	diffs map[string]*BucketDiff, expected map[string]map[string]bool) error {
+	name := record.Type().Name()
+	d, ok := diffs[name]
+	if !ok {
+		// the transforms reject the records of unregistered types
+		return nil
+	}
+	d.SourceCount++
+
+	c := m.dstCodecAt(path, name)
+	id, _ := inspectRecord(record)
+	key, err := encodeKey(dstVersion, id.Interface(), c)
+	if err != nil {
+		return err
+	}
+
+	if expected != nil {
+		expected[name][string(key)] = true
+	}
+
+	var raw []byte
+	if bucket := bucketAt(dstTx, path, name); bucket != nil {
+		raw = bucket.Get(key)
+	}
+	if raw == nil {
+		d.Missing = append(d.Missing, fmt.Sprint(id.Interface()))
+		return nil
+	}
+
+	other := reflect.New(record.Type())
+	err = c.Unmarshal(raw, other.Interface())
+	if err != nil || !reflect.DeepEqual(record.Interface(), other.Elem().Interface()) {
+		d.Different = append(d.Different, fmt.Sprint(id.Interface()))
+	}
+
+	return nil
+}
+
+// compareDestination makes sure every record of the destination bucket of the type has a counterpart
+// in the source and is present in all of its indexes, and that every index entry points to an existing record.
+// If expected is nil, the records are looked up in the source bucket of the type.
+func (m *Migrator) compareDestination(srcTx, dstTx *bolt.Tx, srcVersion string, path []string, inst interface{},
+	d *BucketDiff, expected map[string]bool) error {
+	typ := reflect.Indirect(reflect.ValueOf(inst)).Type()
+	name := typ.Name()
+
+	bucket := bucketAt(dstTx, path, name)
+	if bucket == nil {
+		return nil
+	}
+
+	indexed, err := indexedIDs(bucket, d)
+	if err != nil {
+		return err
+	}
+
+	srcBucket := bucketAt(srcTx, path, m.sourceNameAt(path, name))
+	c := m.dstCodecAt(path, name)
+
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		d.DestinationCount++
+
+		record := reflect.New(typ)
+		err := c.Unmarshal(v, record.Interface())
+		if err != nil {
+			return &Error{Bucket: d.Name, Key: append([]byte(nil), k...), Type: typ, Err: err}
+		}
+		id, fields := inspectRecord(record)
+
+		var found bool
+		switch {
+		case expected != nil:
+			found = expected[string(k)]
+		case srcBucket != nil:
+			srcKey, err := encodeKey(srcVersion, id.Interface(), m.codecAt(path, name))
+			if err != nil {
+				return err
+			}
+			found = srcBucket.Get(srcKey) != nil
+		}
+		if !found {
+			d.Unexpected = append(d.Unexpected, fmt.Sprint(id.Interface()))
+		}
+
+		for field, value := range fields {
+			if !isZero(value) && !indexed[field][string(k)] {
+				d.Unindexed = append(d.Unindexed, fmt.Sprintf("%s: %v", field, id.Interface()))
+			}
+		}
+
+		return nil
+	})
+}
+
+// indexedIDs returns the ids referenced by each index of the bucket, by field,
+// and reports the index entries that point to a record that doesn't exist.
+func indexedIDs(bucket *bolt.Bucket, d *BucketDiff) (map[string]map[string]bool, error) {
+	indexed := make(map[string]map[string]bool)
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil && bytes.HasPrefix(k, []byte(indexPrefix)) {
+			indexed[string(k[len(indexPrefix):])] = make(map[string]bool)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for field, refs := range indexed {
+		err = walkIndex(bucket.Bucket([]byte(indexPrefix+field)), func(id []byte) {
+			refs[string(id)] = true
+			if bucket.Get(id) == nil {
+				d.DanglingIndexes = append(d.DanglingIndexes, fmt.Sprintf("%s: %q", field, id))
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return indexed, nil
+}
+
+// walkIndex calls fn with every id referenced by an index, whatever its layout.
+func walkIndex(b *bolt.Bucket, fn func(id []byte)) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			fn(v)
+			return nil
+		}
+
+		// the ids bucket of list indexes references values, not records
+		if bytes.Equal(k, []byte("storm__ids")) {
+			return nil
+		}
+
+		return walkIndex(b.Bucket(k), fn)
+	})
+}
+
+// verifyKV compares the keys and the values of a key value bucket, decoding the keys of the source with decodeKey.
+func (m *Migrator) verifyKV(src *bolt.DB, srcVersion string, dst *bolt.DB, dstVersion string, path []string, name string,
+	decodeKey func(version string, k []byte) (interface{}, bool)) (*BucketDiff, error) {
+	d := BucketDiff{Name: pathName(path, name), Kind: KVBucket}
+
+	err := src.View(func(srcTx *bolt.Tx) error {
+		return dst.View(func(dstTx *bolt.Tx) error {
+			srcBucket := bucketAt(srcTx, path, m.sourceNameAt(path, name))
+			dstBucket := bucketAt(dstTx, path, name)
+			found := make(map[string]bool)
+
+			if srcBucket != nil {
+				err := srcBucket.ForEach(func(k, v []byte) error {
+					if v == nil {
+						return nil
+					}
+					d.SourceCount++
+
+					key, ok := decodeKey(srcVersion, k)
+					if !ok {
+						d.Missing = append(d.Missing, fmt.Sprintf("%q", k))
+						return nil
+					}
+
+					newKey, err := encodeKey(dstVersion, key, m.dstCodecAt(path, name))
+					if err != nil {
+						return err
+					}
+
+					var other []byte
+					if dstBucket != nil {
+						other = dstBucket.Get(newKey)
+					}
+
+					switch {
+					case other == nil:
+						d.Missing = append(d.Missing, fmt.Sprint(key))
+					case !m.equalValues(path, name, v, other):
+						d.Different = append(d.Different, fmt.Sprint(key))
+					}
+
+					found[string(newKey)] = true
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			if dstBucket == nil {
+				return nil
+			}
+
+			return dstBucket.ForEach(func(k, v []byte) error {
+				if v == nil {
+					return nil
+				}
+				d.DestinationCount++
+				if !found[string(k)] {
+					d.Unexpected = append(d.Unexpected, fmt.Sprintf("%q", k))
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(d.Missing)
+	sort.Strings(d.Different)
+	sort.Strings(d.Unexpected)
+	return &d, nil
+}
+
+// equalValues compares a raw value of the source with one of the destination,
+// decoding them if their encoding differs.
+func (m *Migrator) equalValues(path []string, name string, a, b []byte) bool {
+	if bytes.Equal(a, b) && m.convertTo == nil {
+		return true
+	}
+
+	va, err := m.decodeKVValue(name, a, m.codecAt(path, name))
+	if err != nil {
+		return false
+	}
+
+	vb, err := m.decodeKVValue(name, b, m.dstCodecAt(path, name))
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(va, vb)
+}
+
+// inspectRecord returns the id and the indexed fields of a record, following the rules used by Storm.
+func inspectRecord(v reflect.Value) (reflect.Value, map[string]reflect.Value) {
+	var id reflect.Value
+	fields := make(map[string]reflect.Value)
+	inspectFields(v, &id, fields)
+
+	// the field named ID is only used if no field is tagged as the id
+	if s := reflect.Indirect(v); !id.IsValid() && s.Kind() == reflect.Struct {
+		if f, ok := s.Type().FieldByName("ID"); ok && f.PkgPath == "" && len(f.Index) == 1 {
+			id = s.Field(f.Index[0])
+		}
+	}
+
+	return id, fields
+}
+
+func inspectFields(v reflect.Value, id *reflect.Value, fields map[string]reflect.Value) {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		for _, tag := range strings.Split(f.Tag.Get("storm"), ",") {
+			switch tag {
+			case "id":
+				if !id.IsValid() {
+					*id = v.Field(i)
+				}
+			case "index", "unique":
+				if _, ok := fields[f.Name]; !ok {
+					fields[f.Name] = v.Field(i)
+				}
+			case "inline":
+				inspectFields(v.Field(i), id, fields)
+			}
+		}
+	}
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// Verify option compares the source and the destination databases once the migration is done.
+// Run returns a *VerificationError if differences are found.
+func Verify() func(*Migrator) error {
+	return func(m *Migrator) error {
+		m.verifyAfterRun = true
+		return nil
+	}
+}
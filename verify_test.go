@@ -0,0 +1,122 @@
+package migrator_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	migrator "github.com/asdine/storm-migrator"
+	stormv04 "github.com/asdine/storm-migrator/v0.4"
+	stormv06 "github.com/asdine/storm-migrator/v0.6"
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+type Indexed struct {
+	ID   int
+	Name string `storm:"index"`
+}
+
+func TestVerify(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = dbv04.Save(&Indexed{ID: i + 1, Name: fmt.Sprintf("name%d", i%2)})
+		require.NoError(t, err)
+	}
+	dbv04.Close()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B), new(Indexed))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	err = m.Run(filepath.Join(dir, "v06.db"), migrator.Verify())
+	require.NoError(t, err)
+
+	r, err := m.Verify(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	require.True(t, r.OK())
+	require.Len(t, r.Buckets, 4)
+	require.Equal(t, 10, r.Buckets[0].SourceCount)
+	require.Equal(t, 10, r.Buckets[0].DestinationCount)
+	require.Equal(t, migrator.KVBucket, r.Buckets[3].Kind)
+	require.Equal(t, 20, r.Buckets[3].DestinationCount)
+
+	db, err := stormv06.Open(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	err = db.DeleteStruct(&A{ID: 3})
+	require.NoError(t, err)
+	err = db.Save(&B{ID: "4", Field1: 1000})
+	require.NoError(t, err)
+	err = db.Save(&A{ID: 100, Field2: time.Now()})
+	require.NoError(t, err)
+	err = db.Set("bucket", "string0", 1000)
+	require.NoError(t, err)
+	err = db.Bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Indexed")).Delete([]byte{0, 0, 0, 0, 0, 0, 0, 2})
+	})
+	require.NoError(t, err)
+	db.Close()
+
+	r, err = m.Verify(filepath.Join(dir, "v06.db"))
+	require.NoError(t, err)
+	require.False(t, r.OK())
+	require.Equal(t, []string{"3"}, r.Buckets[0].Missing)
+	require.Equal(t, []string{"100"}, r.Buckets[0].Unexpected)
+	require.Equal(t, []string{"4"}, r.Buckets[1].Different)
+	require.Equal(t, []string{"2"}, r.Buckets[2].Missing)
+	require.Len(t, r.Buckets[2].DanglingIndexes, 1)
+	require.Equal(t, []string{"string0"}, r.Buckets[3].Different)
+	require.Contains(t, r.String(), "missing: 3")
+
+	// a step losing records is caught by Run
+	m = migrator.New(path)
+	m.AddBuckets(new(A), new(B), new(Indexed))
+	err = m.RegisterStep(&testStep{from: "0.6", to: "0.6.0-app.1", run: func(db *bolt.DB, ctx migrator.Context) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("A")).Delete([]byte{0, 0, 0, 0, 0, 0, 0, 1})
+		})
+	}})
+	require.NoError(t, err)
+	err = m.Run(filepath.Join(dir, "other.db"), migrator.Verify())
+	var verr *migrator.VerificationError
+	require.True(t, errors.As(err, &verr))
+	require.Equal(t, []string{"1"}, verr.Report.Buckets[0].Missing)
+}
+
+type TaggedID struct {
+	ID   int
+	Code string `storm:"id"`
+	Name string `storm:"index"`
+}
+
+func TestVerifyTaggedID(t *testing.T) {
+	dir, path, cleanup := prepareDB(t)
+	defer cleanup()
+
+	dbv04, err := stormv04.Open(path)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		// the records share the same ID field, they are stored by their tagged id
+		err = dbv04.Save(&TaggedID{ID: 1, Code: fmt.Sprintf("code%d", i), Name: fmt.Sprintf("name%d", i)})
+		require.NoError(t, err)
+	}
+	dbv04.Close()
+
+	m := migrator.New(path)
+	m.AddBuckets(new(A), new(B), new(TaggedID))
+	m.AddKV("bucket", []interface{}{new(int), new(string)})
+	// Storm v0.4 and v0.5 prefer the tagged id to the field named ID, even if it comes first
+	err = m.Run(filepath.Join(dir, "v05.db"), migrator.TargetVersion("0.5"), migrator.Verify())
+	require.NoError(t, err)
+
+	r, err := m.Verify(filepath.Join(dir, "v05.db"))
+	require.NoError(t, err)
+	require.True(t, r.OK(), r.String())
+	require.Equal(t, 3, r.Buckets[2].SourceCount)
+	require.Equal(t, 3, r.Buckets[2].DestinationCount)
+}